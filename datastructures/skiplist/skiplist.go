@@ -19,6 +19,9 @@ func newNode(score int, value interface{}, height int) *Node {
 type SkipList struct {
 	Head              *Node
 	MaxHeight, Height int
+
+	// Number of nodes currently in the list
+	length int
 }
 
 func NewSkipList(maxHeight int) *SkipList {
@@ -63,6 +66,12 @@ func (sl *SkipList) Insert(score int, value interface{}) {
 		toInsert.Next[level] = tower[level].Next[level]
 		tower[level].Next[level] = toInsert
 	}
+
+	sl.length++
+}
+
+func (sl *SkipList) Len() int {
+	return sl.length
 }
 
 func (sl *SkipList) RangeByScore(mn, mx int) []interface{} {
@@ -84,3 +93,36 @@ func (sl *SkipList) RangeByScore(mn, mx int) []interface{} {
 
 	return values
 }
+
+// Remove all nodes with mn <= score <= mx and return their values in order.
+func (sl *SkipList) DeleteRangeByScore(mn, mx int) []interface{} {
+	values := []interface{}{}
+	tower := make([]*Node, sl.Height)
+	current := sl.Head
+
+	for level := sl.Height - 1; level >= 0; level-- {
+		for current.Next[level] != nil && current.Next[level].Score < mn {
+			current = current.Next[level]
+		}
+		tower[level] = current
+	}
+
+	for level := 0; level < sl.Height; level++ {
+		next := tower[level].Next[level]
+		for next != nil && next.Score <= mx {
+			if level == 0 {
+				values = append(values, next.Value)
+			}
+			next = next.Next[level]
+		}
+		tower[level].Next[level] = next
+	}
+
+	for sl.Height > 1 && sl.Head.Next[sl.Height-1] == nil {
+		sl.Height--
+	}
+
+	sl.length -= len(values)
+
+	return values
+}
@@ -66,3 +66,39 @@ func TestSkipListRangeByScore(t *testing.T) {
 		}
 	}
 }
+
+func TestSkipListDeleteRangeByScore(t *testing.T) {
+	sl := NewSkipList(4)
+
+	for score := 1; score <= 10; score++ {
+		sl.Insert(score, score)
+	}
+
+	deleted := sl.DeleteRangeByScore(3, 6)
+	expected := []int{3, 4, 5, 6}
+	if len(deleted) != len(expected) {
+		t.Fatalf("Expected %d deleted values, got %d", len(expected), len(deleted))
+	}
+	for idx, value := range deleted {
+		if value.(int) != expected[idx] {
+			t.Fatalf("Expected deleted[%d] == %d, got %d", idx, expected[idx], value)
+		}
+	}
+
+	if sl.Len() != 6 {
+		t.Fatalf("Expected sl.Len() == %d, got %d", 6, sl.Len())
+	}
+
+	remaining := sl.RangeByScore(0, 100)
+	expected = []int{1, 2, 7, 8, 9, 10}
+	for idx, value := range remaining {
+		if value.(int) != expected[idx] {
+			t.Fatalf("Expected remaining[%d] == %d, got %d", idx, expected[idx], value)
+		}
+	}
+
+	sl.DeleteRangeByScore(0, 100)
+	if sl.Len() != 0 || sl.Head.Next[0] != nil {
+		t.Fatal("Expected list to be empty")
+	}
+}
@@ -0,0 +1,116 @@
+// Command meansclient talks to a means-to-an-end server.
+//
+// Commands are read one per line from standard input or from the files given
+// as arguments. Both the human readable form (`I 12345 101`, `Q 1000 2000`)
+// and CSV (`I,12345,101`) are accepted. Blank lines and lines starting with
+// '#' are skipped. The answer to every query is printed on its own line.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/waterfountain1996/protohackers/problems/02-means-to-an-end/meansproto"
+)
+
+var errInvalidCommand = errors.New("expected `I <timestamp> <price>` or `Q <mintime> <maxtime>`")
+
+func parseCommand(line string) (meansproto.Message, error) {
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(fields) != 3 {
+		return meansproto.Message{}, errInvalidCommand
+	}
+
+	a, err := strconv.ParseInt(fields[1], 10, 32)
+	if err != nil {
+		return meansproto.Message{}, err
+	}
+
+	b, err := strconv.ParseInt(fields[2], 10, 32)
+	if err != nil {
+		return meansproto.Message{}, err
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "I":
+		return meansproto.EncodeInsert(int32(a), int32(b)), nil
+	case "Q":
+		return meansproto.EncodeQuery(int32(a), int32(b)), nil
+	default:
+		return meansproto.Message{}, errInvalidCommand
+	}
+}
+
+func run(conn net.Conn, src io.Reader, name string) error {
+	scanner := bufio.NewScanner(src)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		msg, err := parseCommand(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", name, lineno, err)
+		}
+
+		if _, err := conn.Write(msg[:]); err != nil {
+			return err
+		}
+
+		if msg.Type() == meansproto.QueryMessage {
+			mean, err := meansproto.ReadResponse(conn)
+			if err != nil {
+				return err
+			}
+			fmt.Println(mean)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func main() {
+	address := flag.String("addr", "127.0.0.1:10000", "server address")
+	flag.Parse()
+
+	conn, err := net.Dial("tcp", *address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	if flag.NArg() == 0 {
+		if err := run(conn, os.Stdin, "<stdin>"); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	for _, path := range flag.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = run(conn, f, path)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -1,104 +1,53 @@
 package main
 
 import (
-	"encoding/binary"
-	"fmt"
+	"flag"
 	"io"
 	"log"
 	"net"
 
-	"github.com/waterfountain1996/protohackers/datastructures/skiplist"
+	"github.com/waterfountain1996/protohackers/problems/02-means-to-an-end/meansproto"
 )
 
-type MessageType rune
-
-const (
-	InsertMessage MessageType = 'I'
-	QueryMessage  MessageType = 'Q'
-)
-
-const MessageLength = 9
-
-type Message [MessageLength]byte
-
-func MessageFromSlice(b []byte) Message {
-	return Message(b)
-}
-
-func (msg *Message) String() string {
-	return fmt.Sprintf("%c %d %d", rune(msg.Type()), msg.MinTime(), msg.MaxTime())
-}
-
-func (msg *Message) Type() MessageType {
-	return MessageType(msg[0])
-}
-
-func (msg *Message) readInt32(offset uint) int32 {
-	val := binary.BigEndian.Uint32(msg[offset:])
-	return int32(val)
-}
-
-func (msg *Message) Timestamp() int32 {
-	return msg.readInt32(1)
-}
-
-func (msg *Message) Price() int32 {
-	return msg.readInt32(5)
-}
-
-func (msg *Message) MinTime() int32 {
-	return msg.readInt32(1)
+type server struct {
+	limits    Limits
+	policy    Policy
+	overrides policyOverrides
+	budget    *Budget
 }
 
-func (msg *Message) MaxTime() int32 {
-	return msg.readInt32(5)
-}
-
-func computeMean(sl *skiplist.SkipList, start, end int) int {
-	mean, n := 0, 0
-	for _, value := range sl.RangeByScore(start, end) {
-		mean += int(value.(int32))
-		n++
-	}
-
-	if n == 0 {
-		return 0
-	}
-
-	return mean / n
-}
-
-func connHandler(conn net.Conn) {
+func (srv *server) connHandler(conn net.Conn) {
 	defer log.Printf("%s disconnected\n", conn.RemoteAddr())
 	defer conn.Close()
 
-	sl := skiplist.NewSkipList(16)
+	sess := newSession(srv.limits, srv.overrides.policyFor(srv.policy, conn.RemoteAddr()), srv.budget)
+	defer sess.Close()
 
 	for {
-		b := make([]byte, MessageLength)
-		if _, err := io.ReadFull(conn, b); err != nil {
+		msg, err := meansproto.ReadMessage(conn)
+		if err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				break
 			}
-			log.Fatalf("Read error: %s\n", err)
+			if err == meansproto.ErrUnknownType {
+				// Invalid message
+				return
+			}
+			log.Printf("%s: read error: %s\n", conn.RemoteAddr(), err)
+			return
 		}
 
-		msg := MessageFromSlice(b)
-
 		switch t := msg.Type(); t {
-		case InsertMessage:
-			start := int(msg.Timestamp())
-			end := start
-			existing := sl.RangeByScore(start, end)
-			if len(existing) == 0 {
-				sl.Insert(int(msg.Timestamp()), msg.Price())
+		case meansproto.InsertMessage:
+			if err := sess.Insert(msg.Timestamp(), msg.Price()); err != nil {
+				log.Printf("%s: %s\n", conn.RemoteAddr(), err)
+				return
 			}
-		case QueryMessage:
-			mean := computeMean(sl, int(msg.MinTime()), int(msg.MaxTime()))
-			outBuffer := make([]byte, 4)
-			binary.BigEndian.PutUint32(outBuffer, uint32(mean))
-			if _, err := conn.Write(outBuffer); err != nil {
-				log.Fatalf("Write error: %s\n", err)
+		case meansproto.QueryMessage:
+			mean := sess.Mean(msg.MinTime(), msg.MaxTime())
+			if _, err := conn.Write(meansproto.EncodeResponse(mean)); err != nil {
+				log.Printf("%s: write error: %s\n", conn.RemoteAddr(), err)
+				return
 			}
 		default:
 			// Invalid message
@@ -108,6 +57,31 @@ func connHandler(conn net.Conn) {
 }
 
 func main() {
+	var srv server
+
+	flag.IntVar(&srv.limits.MaxSessionPoints, "session-max-points", 0, "maximum number of entries per session (0 for unlimited)")
+	maxPoints := flag.Int64("max-points", 0, "maximum number of entries across all sessions (0 for unlimited)")
+	retention := flag.Int("retention", 0, "drop prices older than this many seconds before the newest one (0 to keep all)")
+	downsampleAfter := flag.Int("downsample-after", 0, "aggregate prices older than this many seconds before the newest one (0 to disable)")
+	bucketWidth := flag.Int("bucket-width", 60, "width of downsampled buckets in seconds")
+	duplicates := flag.String("duplicates", KeepFirst.String(), "duplicate timestamp policy: keep-first, keep-last, average or reject (not applied to downsampled timestamps)")
+	flag.Var(&srv.overrides, "duplicates-for", "per-network duplicate policy override as CIDR=policy (repeatable)")
+	flag.BoolVar(&srv.policy.RejectLate, "reject-late", false, "disconnect clients inserting prices older than the watermark")
+	lateness := flag.Int("allowed-lateness", 0, "how many seconds behind the newest price an insert may be with -reject-late")
+	flag.Parse()
+
+	policy, err := ParseDuplicatePolicy(*duplicates)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv.policy.Duplicates = policy
+	srv.policy.AllowedLateness = int32(*lateness)
+
+	srv.limits.Retention = int32(*retention)
+	srv.limits.DownsampleAfter = int32(*downsampleAfter)
+	srv.limits.BucketWidth = int32(*bucketWidth)
+	srv.budget = NewBudget(*maxPoints)
+
 	ln, err := net.Listen("tcp", ":10000")
 	if err != nil {
 		log.Fatal(err)
@@ -123,6 +97,6 @@ func main() {
 
 		log.Printf("TCP connection from %s\n", conn.RemoteAddr())
 
-		go connHandler(conn)
+		go srv.connHandler(conn)
 	}
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/02-means-to-an-end/meansproto"
+)
+
+// Connection that fails with ECONNRESET once `after` bytes have been read.
+type resetConn struct {
+	net.Conn
+	after int
+}
+
+func (c *resetConn) Read(p []byte) (int, error) {
+	if c.after <= 0 {
+		return 0, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	if len(p) > c.after {
+		p = p[:c.after]
+	}
+	n, err := c.Conn.Read(p)
+	c.after -= n
+	return n, err
+}
+
+func serve(t *testing.T, srv *server, conn net.Conn) <-chan struct{} {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.connHandler(conn)
+	}()
+	return done
+}
+
+func waitDone(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handler did not return")
+	}
+}
+
+func TestConnHandler(t *testing.T) {
+	srv := &server{budget: NewBudget(0)}
+	client, conn := net.Pipe()
+	done := serve(t, srv, conn)
+
+	for _, msg := range []meansproto.Message{
+		meansproto.EncodeInsert(12345, 101),
+		meansproto.EncodeInsert(12346, 102),
+		meansproto.EncodeInsert(12347, 100),
+		meansproto.EncodeInsert(40960, 5),
+		meansproto.EncodeQuery(12288, 16384),
+	} {
+		if _, err := client.Write(msg[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mean, err := meansproto.ReadResponse(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mean != 101 {
+		t.Errorf("want %d have %d", 101, mean)
+	}
+
+	client.Close()
+	waitDone(t, done)
+}
+
+func TestConnHandlerReset(t *testing.T) {
+	srv := &server{budget: NewBudget(0)}
+	client, conn := net.Pipe()
+
+	// Reset halfway through the second frame
+	done := serve(t, srv, &resetConn{Conn: conn, after: meansproto.MessageLength + 4})
+
+	msg := meansproto.EncodeInsert(1, 1)
+	go func() {
+		client.Write(msg[:])
+		client.Write(msg[:4])
+	}()
+
+	waitDone(t, done)
+	client.Close()
+
+	if used := srv.budget.used.Load(); used != 0 {
+		t.Errorf("want %d used have %d", 0, used)
+	}
+}
+
+func TestConnHandlerWriteError(t *testing.T) {
+	srv := &server{budget: NewBudget(0)}
+	client, conn := net.Pipe()
+	done := serve(t, srv, conn)
+
+	msg := meansproto.EncodeQuery(0, 1)
+	if _, err := client.Write(msg[:]); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	waitDone(t, done)
+
+	if _, err := conn.Write([]byte{0}); err == nil {
+		t.Error("expected connection to be closed")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// A 128 bit two's complement integer. Sums of int32 prices are accumulated
+// in it so that no realistic number of inserts can overflow.
+type wideInt struct {
+	hi int64
+	lo uint64
+}
+
+func wideFrom(v int64) wideInt {
+	var w wideInt
+	w.add(v)
+	return w
+}
+
+func (w *wideInt) add(v int64) {
+	var ext int64
+	if v < 0 {
+		// Sign extend `v` into the high word
+		ext = -1
+	}
+	lo, carry := bits.Add64(w.lo, uint64(v), 0)
+	w.hi += ext + int64(carry)
+	w.lo = lo
+}
+
+func (w *wideInt) addWide(v wideInt) {
+	lo, carry := bits.Add64(w.lo, v.lo, 0)
+	w.hi += v.hi + int64(carry)
+	w.lo = lo
+}
+
+// Whether the value fits into an int64 without loss.
+func (w wideInt) isInt64() bool {
+	return (w.hi == 0 && w.lo>>63 == 0) || (w.hi == -1 && w.lo>>63 == 1)
+}
+
+func (w wideInt) bigInt() *big.Int {
+	b := big.NewInt(w.hi)
+	b.Lsh(b, 64)
+	return b.Add(b, new(big.Int).SetUint64(w.lo))
+}
+
+// Divide by a positive `n`, rounding toward zero: both 2.5 and -2.5 are
+// rounded to 2 and -2 respectively. The quotient of a sum of int32 values by
+// their count always fits into an int64.
+func (w wideInt) quo(n int64) int64 {
+	if w.isInt64() {
+		return int64(w.lo) / n
+	}
+	return new(big.Int).Quo(w.bigInt(), big.NewInt(n)).Int64()
+}
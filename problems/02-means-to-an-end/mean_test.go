@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestWideIntAdd(t *testing.T) {
+	tests := []struct {
+		give []int64
+	}{
+		{give: []int64{1, 2, 3}},
+		{give: []int64{-1, -2, 3}},
+		{give: []int64{math.MaxInt64, math.MaxInt64, math.MaxInt64}},
+		{give: []int64{math.MinInt64, math.MinInt64, 1}},
+		{give: []int64{math.MaxInt64, math.MaxInt64, math.MinInt64, math.MinInt64, -2}},
+	}
+
+	for _, test := range tests {
+		var (
+			w    wideInt
+			want = new(big.Int)
+		)
+		for _, v := range test.give {
+			w.add(v)
+			want.Add(want, big.NewInt(v))
+		}
+
+		if have := w.bigInt(); have.Cmp(want) != 0 {
+			t.Errorf("%v: want %s have %s", test.give, want, have)
+		}
+	}
+}
+
+func TestWideIntQuo(t *testing.T) {
+	huge := wideFrom(math.MaxInt64)
+	huge.add(math.MaxInt64)
+
+	tests := []struct {
+		give wideInt
+		n    int64
+		want int64
+	}{
+		{give: wideFrom(7), n: 2, want: 3},
+		{give: wideFrom(-7), n: 2, want: -3},
+		{give: wideFrom(-1), n: 2, want: 0},
+		{give: huge, n: 4, want: math.MaxInt64 / 2},
+	}
+
+	for _, test := range tests {
+		if have := test.give.quo(test.n); have != test.want {
+			t.Errorf("%s / %d: want %d have %d", test.give.bigInt(), test.n, test.want, have)
+		}
+	}
+}
+
+func TestMeanExtremes(t *testing.T) {
+	tests := []struct {
+		name  string
+		price func(ts int32) int32
+		want  int32
+	}{
+		{
+			name:  "max",
+			price: func(int32) int32 { return math.MaxInt32 },
+			want:  math.MaxInt32,
+		},
+		{
+			name:  "min",
+			price: func(int32) int32 { return math.MinInt32 },
+			want:  math.MinInt32,
+		},
+		{
+			// Alternating extremes average to -0.5, rounded toward zero
+			name: "alternating",
+			price: func(ts int32) int32 {
+				if ts%2 == 0 {
+					return math.MaxInt32
+				}
+				return math.MinInt32
+			},
+			want: 0,
+		},
+	}
+
+	for _, test := range tests {
+		sess := newSession(Limits{}, Policy{}, NewBudget(0))
+		for ts := int32(0); ts < 1000; ts++ {
+			sess.Insert(ts, test.price(ts))
+		}
+
+		if mean := sess.Mean(math.MinInt32, math.MaxInt32); mean != test.want {
+			t.Errorf("%s: want %d have %d", test.name, test.want, mean)
+		}
+	}
+}
+
+func TestMeanAveragedDuplicatesOverflow(t *testing.T) {
+	sess := newSession(Limits{}, Policy{Duplicates: AverageDuplicates}, NewBudget(0))
+	sess.Insert(0, math.MaxInt32)
+
+	// Push the duplicate sum far past what an int64 can hold
+	smp := sess.sl.Head.Next[0].Value.(*sample)
+	for i := 0; i < 4; i++ {
+		smp.sum.addWide(wideFrom(math.MaxInt64))
+		smp.count += math.MaxInt64 / math.MaxInt32
+	}
+
+	want := new(big.Int).Quo(smp.sum.bigInt(), big.NewInt(smp.count)).Int64()
+	if mean := sess.Mean(0, 0); int64(mean) != want {
+		t.Errorf("want %d have %d", want, mean)
+	}
+}
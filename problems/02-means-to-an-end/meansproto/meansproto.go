@@ -0,0 +1,131 @@
+// Package meansproto implements the wire format of the means-to-an-end
+// protocol: fixed size 9 byte insert/query frames sent by the client and
+// 4 byte responses sent back by the server.
+package meansproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type MessageType byte
+
+const (
+	InsertMessage MessageType = 'I'
+	QueryMessage  MessageType = 'Q'
+)
+
+const (
+	MessageLength  = 9
+	ResponseLength = 4
+)
+
+var (
+	ErrShortMessage  = errors.New("meansproto: short message")
+	ErrShortResponse = errors.New("meansproto: short response")
+	ErrUnknownType   = errors.New("meansproto: unknown message type")
+)
+
+type Message [MessageLength]byte
+
+// Convert a raw frame to a Message without validating its type.
+func MessageFromSlice(b []byte) Message {
+	return Message(b)
+}
+
+func (msg *Message) String() string {
+	return fmt.Sprintf("%c %d %d", rune(msg.Type()), msg.MinTime(), msg.MaxTime())
+}
+
+func (msg *Message) Type() MessageType {
+	return MessageType(msg[0])
+}
+
+func (msg *Message) readInt32(offset uint) int32 {
+	val := binary.BigEndian.Uint32(msg[offset:])
+	return int32(val)
+}
+
+func (msg *Message) Timestamp() int32 {
+	return msg.readInt32(1)
+}
+
+func (msg *Message) Price() int32 {
+	return msg.readInt32(5)
+}
+
+func (msg *Message) MinTime() int32 {
+	return msg.readInt32(1)
+}
+
+func (msg *Message) MaxTime() int32 {
+	return msg.readInt32(5)
+}
+
+func encode(t MessageType, a, b int32) Message {
+	var msg Message
+	msg[0] = byte(t)
+	binary.BigEndian.PutUint32(msg[1:], uint32(a))
+	binary.BigEndian.PutUint32(msg[5:], uint32(b))
+	return msg
+}
+
+// Build an insert frame for the given timestamp and price.
+func EncodeInsert(timestamp, price int32) Message {
+	return encode(InsertMessage, timestamp, price)
+}
+
+// Build a query frame for the inclusive [mintime, maxtime] range.
+func EncodeQuery(mintime, maxtime int32) Message {
+	return encode(QueryMessage, mintime, maxtime)
+}
+
+// Parse a single frame from `b`. Extra trailing bytes are ignored.
+func Decode(b []byte) (Message, error) {
+	if len(b) < MessageLength {
+		return Message{}, ErrShortMessage
+	}
+
+	msg := MessageFromSlice(b[:MessageLength])
+	switch msg.Type() {
+	case InsertMessage, QueryMessage:
+		return msg, nil
+	default:
+		return msg, ErrUnknownType
+	}
+}
+
+// Read and decode the next frame from `r`.
+func ReadMessage(r io.Reader) (Message, error) {
+	b := make([]byte, MessageLength)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return Message{}, err
+	}
+	return Decode(b)
+}
+
+// Encode the server's answer to a query.
+func EncodeResponse(mean int32) []byte {
+	b := make([]byte, ResponseLength)
+	binary.BigEndian.PutUint32(b, uint32(mean))
+	return b
+}
+
+// Decode the server's answer to a query.
+func DecodeResponse(b []byte) (int32, error) {
+	if len(b) < ResponseLength {
+		return 0, ErrShortResponse
+	}
+	return int32(binary.BigEndian.Uint32(b)), nil
+}
+
+// Read and decode the next response from `r`.
+func ReadResponse(r io.Reader) (int32, error) {
+	b := make([]byte, ResponseLength)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	return DecodeResponse(b)
+}
@@ -0,0 +1,109 @@
+package meansproto
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestEncodeInsert(t *testing.T) {
+	msg := EncodeInsert(12345, 101)
+	want := Message{0x49, 0x00, 0x00, 0x30, 0x39, 0x00, 0x00, 0x00, 0x65}
+	if msg != want {
+		t.Errorf("want %v have %v", want, msg)
+	}
+}
+
+func TestEncodeQuery(t *testing.T) {
+	msg := EncodeQuery(1000, 100000)
+	want := Message{0x51, 0x00, 0x00, 0x03, 0xe8, 0x00, 0x01, 0x86, 0xa0}
+	if msg != want {
+		t.Errorf("want %v have %v", want, msg)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		give []byte
+		want error
+	}{
+		{give: []byte{0x49, 0, 0, 0, 1, 0, 0, 0, 2}, want: nil},
+		{give: []byte{0x51, 0, 0, 0, 1, 0, 0, 0, 2}, want: nil},
+		{give: []byte{0x58, 0, 0, 0, 1, 0, 0, 0, 2}, want: ErrUnknownType},
+		{give: []byte{0x49, 0, 0, 0}, want: ErrShortMessage},
+		{give: nil, want: ErrShortMessage},
+	}
+
+	for _, test := range tests {
+		if _, err := Decode(test.give); err != test.want {
+			t.Errorf("%v: want %v have %v", test.give, test.want, err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		a, b int32
+	}{
+		{a: 0, b: 0},
+		{a: -1, b: 1},
+		{a: math.MinInt32, b: math.MaxInt32},
+	}
+
+	for _, test := range tests {
+		msg := EncodeInsert(test.a, test.b)
+		decoded, err := ReadMessage(bytes.NewReader(msg[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Timestamp() != test.a || decoded.Price() != test.b {
+			t.Errorf("want %d %d have %d %d", test.a, test.b, decoded.Timestamp(), decoded.Price())
+		}
+
+		mean, err := ReadResponse(bytes.NewReader(EncodeResponse(test.a)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mean != test.a {
+			t.Errorf("want %d have %d", test.a, mean)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte{0x49, 0, 0, 0x30, 0x39, 0, 0, 0, 0x65})
+	f.Add([]byte{0x51, 0, 0, 0x03, 0xe8, 0, 0x01, 0x86, 0xa0})
+	f.Add([]byte{0x00})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := Decode(b)
+		if err == ErrShortMessage {
+			if len(b) >= MessageLength {
+				t.Fatalf("%v rejected as short", b)
+			}
+			return
+		}
+
+		if !bytes.Equal(msg[:], b[:MessageLength]) {
+			t.Fatalf("want %v have %v", b[:MessageLength], msg)
+		}
+
+		if err != nil {
+			return
+		}
+
+		var reencoded Message
+		switch msg.Type() {
+		case InsertMessage:
+			reencoded = EncodeInsert(msg.Timestamp(), msg.Price())
+		case QueryMessage:
+			reencoded = EncodeQuery(msg.MinTime(), msg.MaxTime())
+		default:
+			t.Fatalf("unexpected type %c accepted", msg.Type())
+		}
+
+		if reencoded != msg {
+			t.Fatalf("want %v have %v", msg, reencoded)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	ErrDuplicateTimestamp = errors.New("duplicate timestamp")
+	ErrLateTimestamp      = errors.New("timestamp older than watermark")
+)
+
+// What to do with an insert whose timestamp already holds a price.
+type DuplicatePolicy int
+
+const (
+	KeepFirst DuplicatePolicy = iota
+	KeepLast
+	AverageDuplicates
+	RejectDuplicates
+)
+
+var duplicatePolicyNames = map[DuplicatePolicy]string{
+	KeepFirst:         "keep-first",
+	KeepLast:          "keep-last",
+	AverageDuplicates: "average",
+	RejectDuplicates:  "reject",
+}
+
+func (p DuplicatePolicy) String() string {
+	return duplicatePolicyNames[p]
+}
+
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	for policy, name := range duplicatePolicyNames {
+		if name == s {
+			return policy, nil
+		}
+	}
+	return KeepFirst, fmt.Errorf("unknown duplicate policy %q", s)
+}
+
+// Policy controls how a session treats duplicate and out-of-order inserts.
+//
+// The duplicate policy only covers points that are still stored as such.
+// Once downsampling has folded a timestamp into a bucket, a duplicate insert
+// for it is added to the bucket like any other late point.
+type Policy struct {
+	Duplicates DuplicatePolicy
+
+	// When set, inserts older than the newest timestamp minus
+	// AllowedLateness are rejected and the client is disconnected.
+	RejectLate      bool
+	AllowedLateness int32
+}
+
+// Per-network policy overrides in the form of `CIDR=policy`.
+type policyOverrides []policyOverride
+
+type policyOverride struct {
+	network    *net.IPNet
+	duplicates DuplicatePolicy
+}
+
+func (o *policyOverrides) String() string {
+	entries := []string{}
+	for _, override := range *o {
+		entries = append(entries, override.network.String()+"="+override.duplicates.String())
+	}
+	return strings.Join(entries, ",")
+}
+
+func (o *policyOverrides) Set(value string) error {
+	cidr, name, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected CIDR=policy, got %q", value)
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	duplicates, err := ParseDuplicatePolicy(name)
+	if err != nil {
+		return err
+	}
+
+	*o = append(*o, policyOverride{network: network, duplicates: duplicates})
+	return nil
+}
+
+// Pick the policy for a client connecting from `addr`. The first matching
+// override wins, otherwise `base` is used as is.
+func (o policyOverrides) policyFor(base Policy, addr net.Addr) Policy {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return base
+	}
+
+	for _, override := range o {
+		if override.network.Contains(tcpAddr.IP) {
+			base.Duplicates = override.duplicates
+			return base
+		}
+	}
+
+	return base
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDuplicatePolicy(t *testing.T) {
+	inserts := []insert{
+		{100, 10},
+		{100, 20},
+		{100, 60},
+		{200, 50},
+	}
+
+	tests := []struct {
+		policy  DuplicatePolicy
+		want    int32
+		wantErr error
+	}{
+		{policy: KeepFirst, want: 30},
+		{policy: KeepLast, want: 55},
+		{policy: AverageDuplicates, want: 40},
+		{policy: RejectDuplicates, want: 10, wantErr: ErrDuplicateTimestamp},
+	}
+
+	for _, test := range tests {
+		sess := newSession(Limits{}, Policy{Duplicates: test.policy}, NewBudget(0))
+
+		var err error
+		for _, in := range inserts {
+			if err = sess.Insert(in.ts, in.price); err != nil {
+				break
+			}
+		}
+
+		if err != test.wantErr {
+			t.Errorf("%s: want error %v have %v", test.policy, test.wantErr, err)
+		}
+
+		if mean := sess.Mean(0, 1000); mean != test.want {
+			t.Errorf("%s: want %d have %d", test.policy, test.want, mean)
+		}
+	}
+}
+
+func TestLatePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		give    []insert
+		wantErr error
+	}{
+		{
+			name:   "disabled",
+			policy: Policy{},
+			give:   []insert{{100, 1}, {0, 1}},
+		},
+		{
+			name:    "strictly ordered",
+			policy:  Policy{RejectLate: true},
+			give:    []insert{{100, 1}, {99, 1}},
+			wantErr: ErrLateTimestamp,
+		},
+		{
+			name:   "within lateness",
+			policy: Policy{RejectLate: true, AllowedLateness: 10},
+			give:   []insert{{100, 1}, {90, 1}, {95, 1}},
+		},
+		{
+			name:    "beyond lateness",
+			policy:  Policy{RejectLate: true, AllowedLateness: 10},
+			give:    []insert{{100, 1}, {110, 1}, {99, 1}},
+			wantErr: ErrLateTimestamp,
+		},
+	}
+
+	for _, test := range tests {
+		sess := newSession(Limits{}, test.policy, NewBudget(0))
+
+		var err error
+		for _, in := range test.give {
+			if err = sess.Insert(in.ts, in.price); err != nil {
+				break
+			}
+		}
+
+		if err != test.wantErr {
+			t.Errorf("%s: want error %v have %v", test.name, test.wantErr, err)
+		}
+	}
+}
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	for policy, name := range duplicatePolicyNames {
+		parsed, err := ParseDuplicatePolicy(name)
+		if err != nil || parsed != policy {
+			t.Errorf("%s: want %v have %v (%v)", name, policy, parsed, err)
+		}
+	}
+
+	if _, err := ParseDuplicatePolicy("keep-some"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestPolicyOverrides(t *testing.T) {
+	var overrides policyOverrides
+	if err := overrides.Set("10.0.0.0/8=average"); err != nil {
+		t.Fatal(err)
+	}
+	if err := overrides.Set("0.0.0.0/0=reject"); err != nil {
+		t.Fatal(err)
+	}
+
+	base := Policy{Duplicates: KeepFirst, RejectLate: true}
+
+	tests := []struct {
+		give net.Addr
+		want DuplicatePolicy
+	}{
+		{give: &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, want: AverageDuplicates},
+		{give: &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}, want: RejectDuplicates},
+		{give: &net.UnixAddr{Name: "/tmp/sock"}, want: KeepFirst},
+	}
+
+	for _, test := range tests {
+		policy := overrides.policyFor(base, test.give)
+		if policy.Duplicates != test.want || !policy.RejectLate {
+			t.Errorf("%s: want %v have %v", test.give, test.want, policy.Duplicates)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+
+	"github.com/waterfountain1996/protohackers/datastructures/skiplist"
+)
+
+var ErrMemoryExhausted = errors.New("global point limit reached")
+
+// Limits bound how much price data a single session keeps around.
+// Zero values disable the corresponding limit.
+type Limits struct {
+	// Maximum number of entries (points and buckets) a session may hold.
+	// When full, the oldest entry is evicted to make room.
+	MaxSessionPoints int
+
+	// Entries older than the newest timestamp minus Retention are dropped.
+	Retention int32
+
+	// Points older than the newest timestamp minus DownsampleAfter are
+	// folded into BucketWidth wide buckets keeping only their count and sum.
+	DownsampleAfter int32
+	BucketWidth     int32
+}
+
+func (l Limits) downsampling() bool {
+	return l.DownsampleAfter > 0 && l.BucketWidth > 0
+}
+
+// Budget caps the number of entries stored across all sessions.
+type Budget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+func NewBudget(limit int64) *Budget {
+	return &Budget{limit: limit}
+}
+
+func (b *Budget) reserve() bool {
+	if n := b.used.Add(1); b.limit > 0 && n > b.limit {
+		b.used.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (b *Budget) release(n int) {
+	b.used.Add(-int64(n))
+}
+
+// A stored entry: either a single price or a downsampled bucket.
+type sample struct {
+	// Timestamp of the point or start of the bucket
+	ts int64
+
+	// For buckets, the sum and number of aggregated prices. For points,
+	// the sum and number of averaged duplicate prices.
+	sum    wideInt
+	count  int64
+	bucket bool
+}
+
+// Contribution of the entry to a mean: a bucket counts as all the prices
+// it aggregates, a point counts once regardless of its duplicates.
+func (smp *sample) weight() (wideInt, int64) {
+	if smp.bucket || smp.count == 1 {
+		return smp.sum, smp.count
+	}
+	return wideFrom(smp.sum.quo(smp.count)), 1
+}
+
+// Price history of a single client connection.
+type session struct {
+	sl     *skiplist.SkipList
+	limits Limits
+	policy Policy
+	budget *Budget
+
+	// Newest timestamp inserted so far
+	newest    int64
+	hasNewest bool
+
+	// Everything below this timestamp has been downsampled
+	compacted int64
+}
+
+func newSession(limits Limits, policy Policy, budget *Budget) *session {
+	return &session{
+		sl:        skiplist.NewSkipList(16),
+		limits:    limits,
+		policy:    policy,
+		budget:    budget,
+		compacted: math.MinInt64,
+	}
+}
+
+// Round `ts` down to the start of the bucket containing it. The first
+// bucket is cut short at math.MinInt32, so that every bucket stays within
+// the range of timestamps queries and deletions cover.
+func (s *session) bucketStart(ts int64) int64 {
+	width := int64(s.limits.BucketWidth)
+	start := ts - ts%width
+	if ts%width < 0 {
+		start -= width
+	}
+	return max(start, math.MinInt32)
+}
+
+func (s *session) Insert(timestamp, price int32) error {
+	ts := int64(timestamp)
+
+	if s.policy.RejectLate && s.hasNewest && ts < s.newest-int64(s.policy.AllowedLateness) {
+		return ErrLateTimestamp
+	}
+
+	if s.limits.Retention > 0 && s.hasNewest && ts < s.newest-int64(s.limits.Retention) {
+		// Already outside the retention window
+		return nil
+	}
+
+	if s.limits.downsampling() && ts < s.compacted {
+		// Duplicates can no longer be told apart once downsampled, so the
+		// duplicate policy doesn't apply to them
+		return s.addToBucket(ts, price)
+	}
+
+	for _, value := range s.sl.RangeByScore(int(ts), int(ts)) {
+		if smp := value.(*sample); !smp.bucket {
+			return s.duplicate(smp, price)
+		}
+	}
+
+	if err := s.store(&sample{ts: ts, sum: wideFrom(int64(price)), count: 1}); err != nil {
+		return err
+	}
+
+	if !s.hasNewest || ts > s.newest {
+		s.newest, s.hasNewest = ts, true
+		s.expire()
+		s.downsample()
+	}
+
+	return nil
+}
+
+// Apply the duplicate policy to an insert for an already stored point.
+func (s *session) duplicate(smp *sample, price int32) error {
+	switch s.policy.Duplicates {
+	case KeepLast:
+		smp.sum, smp.count = wideFrom(int64(price)), 1
+	case AverageDuplicates:
+		smp.sum.add(int64(price))
+		smp.count++
+	case RejectDuplicates:
+		return ErrDuplicateTimestamp
+	}
+	return nil
+}
+
+// Insert a new entry, evicting the oldest one if the session is full.
+func (s *session) store(value *sample) error {
+	if s.limits.MaxSessionPoints > 0 && s.sl.Len() >= s.limits.MaxSessionPoints {
+		oldest := s.sl.Head.Next[0].Score
+		s.budget.release(len(s.sl.DeleteRangeByScore(oldest, oldest)))
+	}
+
+	if !s.budget.reserve() {
+		return ErrMemoryExhausted
+	}
+
+	s.sl.Insert(int(value.ts), value)
+	return nil
+}
+
+// Account a late point directly into its already downsampled bucket.
+func (s *session) addToBucket(ts int64, price int32) error {
+	start := s.bucketStart(ts)
+	for _, value := range s.sl.RangeByScore(int(start), int(start)) {
+		if b := value.(*sample); b.bucket {
+			b.sum.add(int64(price))
+			b.count++
+			return nil
+		}
+	}
+	return s.store(&sample{ts: start, sum: wideFrom(int64(price)), count: 1, bucket: true})
+}
+
+// Drop entries that fell out of the retention window.
+func (s *session) expire() {
+	if s.limits.Retention <= 0 {
+		return
+	}
+
+	cutoff := s.newest - int64(s.limits.Retention)
+	if cutoff <= math.MinInt32 {
+		return
+	}
+
+	s.budget.release(len(s.sl.DeleteRangeByScore(math.MinInt32, int(cutoff-1))))
+}
+
+// Fold points older than the downsampling horizon into buckets.
+func (s *session) downsample() {
+	if !s.limits.downsampling() {
+		return
+	}
+
+	cutoff := s.bucketStart(s.newest - int64(s.limits.DownsampleAfter))
+	if cutoff <= s.compacted {
+		return
+	}
+	s.compacted = cutoff
+
+	if cutoff <= math.MinInt32 {
+		return
+	}
+
+	removed := s.sl.DeleteRangeByScore(math.MinInt32, int(cutoff-1))
+	if len(removed) == 0 {
+		return
+	}
+
+	// Entries come out ordered by timestamp, so equal buckets are adjacent.
+	buckets := []*sample{}
+	for _, value := range removed {
+		smp := value.(*sample)
+		start := s.bucketStart(smp.ts)
+		sum, count := smp.weight()
+		if n := len(buckets); n > 0 && buckets[n-1].ts == start {
+			buckets[n-1].sum.addWide(sum)
+			buckets[n-1].count += count
+			continue
+		}
+		buckets = append(buckets, &sample{ts: start, sum: sum, count: count, bucket: true})
+	}
+
+	s.budget.release(len(removed) - len(buckets))
+	for _, b := range buckets {
+		s.sl.Insert(int(b.ts), b)
+	}
+}
+
+// Mean of all prices with mintime <= timestamp <= maxtime, rounded toward
+// zero. Buckets are attributed to their start timestamp.
+func (s *session) Mean(mintime, maxtime int32) int32 {
+	var (
+		sum wideInt
+		n   int64
+	)
+	for _, value := range s.sl.RangeByScore(int(mintime), int(maxtime)) {
+		smpSum, smpCount := value.(*sample).weight()
+		sum.addWide(smpSum)
+		n += smpCount
+	}
+
+	if n == 0 {
+		return 0
+	}
+
+	return int32(sum.quo(n))
+}
+
+// Return everything the session holds to the global budget.
+func (s *session) Close() {
+	s.budget.release(s.sl.Len())
+}
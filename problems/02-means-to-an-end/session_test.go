@@ -0,0 +1,183 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+type insert struct {
+	ts, price int32
+}
+
+func newTestSession(limits Limits, budget *Budget, inserts []insert) *session {
+	sess := newSession(limits, Policy{}, budget)
+	for _, in := range inserts {
+		sess.Insert(in.ts, in.price)
+	}
+	return sess
+}
+
+func TestSessionMean(t *testing.T) {
+	sess := newTestSession(Limits{}, NewBudget(0), []insert{
+		{12345, 101},
+		{12346, 102},
+		{12347, 100},
+		{40960, 5},
+	})
+
+	tests := []struct {
+		mintime, maxtime int32
+		want             int32
+	}{
+		{mintime: 12288, maxtime: 16384, want: 101},
+		{mintime: 0, maxtime: 100000, want: 77},
+		{mintime: 16384, maxtime: 12288, want: 0},
+		{mintime: 50000, maxtime: 60000, want: 0},
+	}
+
+	for _, test := range tests {
+		if mean := sess.Mean(test.mintime, test.maxtime); mean != test.want {
+			t.Errorf("Q %d %d: want %d have %d", test.mintime, test.maxtime, test.want, mean)
+		}
+	}
+}
+
+func TestSessionRetention(t *testing.T) {
+	sess := newTestSession(Limits{Retention: 100}, NewBudget(0), []insert{
+		{0, 10},
+		{50, 20},
+		{150, 30},
+		// Older than the retention window, ignored
+		{10, 1000},
+	})
+
+	if n := sess.sl.Len(); n != 2 {
+		t.Errorf("want %d entries have %d", 2, n)
+	}
+
+	if mean := sess.Mean(0, 200); mean != 25 {
+		t.Errorf("want %d have %d", 25, mean)
+	}
+}
+
+func TestSessionDownsample(t *testing.T) {
+	limits := Limits{DownsampleAfter: 100, BucketWidth: 10}
+	inserts := []insert{}
+	for ts := int32(0); ts < 100; ts++ {
+		inserts = append(inserts, insert{ts, ts})
+	}
+	inserts = append(inserts, insert{1000, 1000})
+	// Late arrival for an already downsampled bucket
+	inserts = append(inserts, insert{-5, 50})
+
+	sess := newTestSession(limits, NewBudget(0), inserts)
+
+	// 10 buckets, one late bucket and the newest raw point
+	if n := sess.sl.Len(); n != 12 {
+		t.Errorf("want %d entries have %d", 12, n)
+	}
+
+	tests := []struct {
+		mintime, maxtime int32
+		want             int32
+	}{
+		{mintime: 0, maxtime: 99, want: 49},
+		{mintime: 20, maxtime: 39, want: 29},
+		{mintime: -10, maxtime: -1, want: 50},
+		{mintime: 1000, maxtime: 1000, want: 1000},
+	}
+
+	for _, test := range tests {
+		if mean := sess.Mean(test.mintime, test.maxtime); mean != test.want {
+			t.Errorf("Q %d %d: want %d have %d", test.mintime, test.maxtime, test.want, mean)
+		}
+	}
+}
+
+func TestSessionMaxPoints(t *testing.T) {
+	sess := newTestSession(Limits{MaxSessionPoints: 3}, NewBudget(0), []insert{
+		{1, 1},
+		{2, 2},
+		{3, 3},
+		{4, 4},
+		{5, 5},
+	})
+
+	if n := sess.sl.Len(); n != 3 {
+		t.Errorf("want %d entries have %d", 3, n)
+	}
+
+	if mean := sess.Mean(0, 10); mean != 4 {
+		t.Errorf("want %d have %d", 4, mean)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	budget := NewBudget(3)
+
+	first := newTestSession(Limits{}, budget, []insert{{1, 1}, {2, 2}})
+	second := newSession(Limits{}, Policy{}, budget)
+
+	if err := second.Insert(1, 1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := second.Insert(2, 2); err != ErrMemoryExhausted {
+		t.Fatalf("want %v have %v", ErrMemoryExhausted, err)
+	}
+
+	first.Close()
+
+	if err := second.Insert(2, 2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	second.Close()
+	if used := budget.used.Load(); used != 0 {
+		t.Errorf("want %d used have %d", 0, used)
+	}
+}
+
+func TestBucketStart(t *testing.T) {
+	tests := []struct {
+		ts, width int64
+		want      int64
+	}{
+		{ts: 0, width: 60, want: 0},
+		{ts: 59, width: 60, want: 0},
+		{ts: 60, width: 60, want: 60},
+		{ts: -1, width: 60, want: -60},
+		{ts: -60, width: 60, want: -60},
+		{ts: -61, width: 60, want: -120},
+		{ts: math.MaxInt32, width: 60, want: math.MaxInt32 - math.MaxInt32%60},
+		// Clamped instead of reaching below the smallest timestamp
+		{ts: math.MinInt32, width: 60, want: math.MinInt32},
+		{ts: math.MinInt32 + 7, width: 60, want: math.MinInt32},
+		{ts: math.MinInt32 + 8, width: 60, want: math.MinInt32 + 8},
+	}
+
+	for _, test := range tests {
+		sess := newSession(Limits{BucketWidth: int32(test.width)}, Policy{}, NewBudget(0))
+		if start := sess.bucketStart(test.ts); start != test.want {
+			t.Errorf("%d/%d: want %d have %d", test.ts, test.width, test.want, start)
+		}
+	}
+}
+
+func TestSessionDownsampleMinTimestamp(t *testing.T) {
+	limits := Limits{DownsampleAfter: 100, BucketWidth: 60, Retention: 1000}
+	sess := newTestSession(limits, NewBudget(0), []insert{
+		{math.MinInt32, 10},
+		{math.MinInt32 + 1, 20},
+		{math.MinInt32 + 500, 30},
+	})
+
+	if mean := sess.Mean(math.MinInt32, math.MinInt32+100); mean != 15 {
+		t.Errorf("want %d have %d", 15, mean)
+	}
+
+	// The bucket at the very bottom expires like everything else
+	sess.Insert(math.MinInt32+2000, 40)
+	if n := sess.sl.Len(); n != 1 {
+		t.Errorf("want %d entries have %d", 1, n)
+	}
+}
@@ -0,0 +1,187 @@
+// Package accounts keeps registered budget-chat usernames and their
+// passwords in a JSON file.
+//
+// Passwords are never stored. Each account holds a random salt and a key
+// derived from the password with PBKDF2-HMAC-SHA256, along with the
+// iteration count used, so that it can be raised without invalidating
+// existing accounts.
+package accounts
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// PBKDF2 iterations used for new passwords.
+	Iterations = 100_000
+
+	SaltLength = 16
+	KeyLength  = sha256.Size
+)
+
+var (
+	ErrRegistered    = errors.New("username is already registered")
+	ErrNotFound      = errors.New("username is not registered")
+	ErrWrongPassword = errors.New("wrong password")
+)
+
+// PBKDF2 as specified in RFC 8018 with HMAC-SHA256 as the PRF.
+func deriveKey(password, salt []byte, iterations, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, length)
+
+	for block := uint32(1); len(key) < length; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			subtle.XORBytes(t, t, u)
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:length]
+}
+
+type account struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	Key        []byte `json:"key"`
+}
+
+func (a account) verify(password string) bool {
+	key := deriveKey([]byte(password), a.Salt, a.Iterations, len(a.Key))
+	return subtle.ConstantTimeCompare(key, a.Key) == 1
+}
+
+// Store is a set of accounts backed by a file, which is rewritten on every
+// change. Usernames are compared ignoring case. Safe for concurrent use.
+type Store struct {
+	path     string
+	lock     sync.Mutex
+	accounts map[string]account
+}
+
+// Open loads the accounts saved in `path`. The file is created on the first
+// registration if it doesn't exist yet.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:     path,
+		accounts: map[string]account{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.accounts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func key(username string) string {
+	return strings.ToLower(username)
+}
+
+// Whether `username` needs a password.
+func (s *Store) Registered(username string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.accounts[key(username)]
+	return ok
+}
+
+// Register `username` with `password` and save the store.
+func (s *Store) Register(username, password string) error {
+	salt := make([]byte, SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	a := account{
+		Salt:       salt,
+		Iterations: Iterations,
+		Key:        deriveKey([]byte(password), salt, Iterations, KeyLength),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.accounts[key(username)]; ok {
+		return ErrRegistered
+	}
+
+	s.accounts[key(username)] = a
+	if err := s.saveLocked(); err != nil {
+		delete(s.accounts, key(username))
+		return err
+	}
+	return nil
+}
+
+// Check `password` against the one `username` was registered with.
+func (s *Store) Verify(username, password string) error {
+	s.lock.Lock()
+	a, ok := s.accounts[key(username)]
+	s.lock.Unlock()
+
+	if !ok {
+		return ErrNotFound
+	}
+	if !a.verify(password) {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// Atomically replace the file with the current accounts. Caller must hold
+// `s.lock`.
+func (s *Store) saveLocked() error {
+	data, err := json.Marshal(s.accounts)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".accounts-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,96 @@
+package accounts
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	// Test vectors from RFC 7914, section 11, and a key shorter than a block
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		want       string
+	}{
+		{
+			password:   "passwd",
+			salt:       "salt",
+			iterations: 1,
+			want:       "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783",
+		},
+		{
+			password:   "Password",
+			salt:       "NaCl",
+			iterations: 80000,
+			want:       "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d",
+		},
+		{
+			password:   "password",
+			salt:       "salt",
+			iterations: 4096,
+			want:       "c5e478d59288c841aa530db6845c4c8d962893a0",
+		},
+	}
+
+	for _, test := range tests {
+		key := deriveKey([]byte(test.password), []byte(test.salt), test.iterations, len(test.want)/2)
+		if have := hex.EncodeToString(key); have != test.want {
+			t.Errorf("%s/%s/%d: want %s have %s", test.password, test.salt, test.iterations, test.want, have)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Registered("alice") {
+		t.Error("want alice unregistered")
+	}
+
+	if err := s.Register("alice", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register("Alice", "other"); err != ErrRegistered {
+		t.Errorf("want %v have %v", ErrRegistered, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("password stored in plain text: %s", data)
+	}
+
+	// Survives a restart
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		password string
+		want     error
+	}{
+		{username: "alice", password: "hunter2", want: nil},
+		{username: "ALICE", password: "hunter2", want: nil},
+		{username: "alice", password: "hunter3", want: ErrWrongPassword},
+		{username: "alice", password: "", want: ErrWrongPassword},
+		{username: "bob", password: "hunter2", want: ErrNotFound},
+	}
+
+	for _, test := range tests {
+		if err := s.Verify(test.username, test.password); err != test.want {
+			t.Errorf("%s/%s: want %v have %v", test.username, test.password, test.want, err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Package bots contains example budget-chat bots.
+package bots
+
+import (
+	"strings"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/server"
+)
+
+// Prefix of the commands bots respond to. It differs from the server's own
+// command prefix, so that bot commands are relayed to the room.
+const CommandPrefix = "!"
+
+const echoHelp = "Commands: !echo <text> repeats text, !help shows this message"
+
+// Echo greets people entering its room and answers !echo and !help.
+type Echo struct{}
+
+func (Echo) OnJoin(u *server.BotUser, username string) {
+	u.Tell(username, "Welcome to "+u.Room()+"! Say !help to see what I can do")
+}
+
+func (Echo) OnLeave(u *server.BotUser, username string) {}
+
+func (Echo) OnMessage(u *server.BotUser, username, text string) {
+	name, args, _ := strings.Cut(strings.TrimSpace(text), " ")
+
+	switch name {
+	case CommandPrefix + "echo":
+		if args = strings.TrimSpace(args); args != "" {
+			u.Say(args)
+		}
+	case CommandPrefix + "help":
+		u.Say(echoHelp)
+	}
+}
@@ -0,0 +1,56 @@
+package bots
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/server"
+)
+
+func TestEcho(t *testing.T) {
+	srv := server.NewServer()
+	if _, err := srv.AddBot("echo", Echo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go srv.Attach(local, server.HandleClient)
+
+	lines := bufio.NewReader(remote)
+	remote.SetDeadline(time.Now().Add(time.Second))
+
+	expect := func(want string) {
+		t.Helper()
+
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatalf("want %q: %s", want, err)
+		}
+		if line = strings.TrimSuffix(line, "\n"); line != want {
+			t.Fatalf("want %q have %q", want, line)
+		}
+	}
+
+	expect(strings.TrimSuffix(server.UsernamePrompt, "\n"))
+	remote.Write([]byte("alice\n"))
+	expect("* This room contains: echo")
+	expect("[echo -> alice] Welcome to lobby! Say !help to see what I can do")
+
+	tests := []struct {
+		give string
+		want string
+	}{
+		{give: "!echo hello there", want: "[echo] hello there"},
+		{give: "!help", want: "[echo] " + echoHelp},
+		{give: "!echo /nick evil", want: "[echo] /nick evil"},
+	}
+
+	for _, test := range tests {
+		remote.Write([]byte(test.give + "\n"))
+		expect(test.want)
+	}
+}
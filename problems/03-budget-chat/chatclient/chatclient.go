@@ -0,0 +1,211 @@
+// Package chatclient talks to a budget-chat server. It takes care of the
+// username handshake and turns the lines sent by the server into typed
+// events, so that scripts, bots and tests don't have to parse them.
+package chatclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Longest line Next accepts from the server.
+const MaxLineLength = 1024 * 1024
+
+var (
+	// Returned by the handshake when the server refuses the username or
+	// the connection. The error text includes the server's reason.
+	ErrRejected = errors.New("chatclient: rejected by server")
+
+	// Returned by the handshake when the username is registered but no
+	// password was given.
+	ErrPasswordRequired = errors.New("chatclient: username is registered, password required")
+
+	// Returned when sending text that would span multiple lines.
+	ErrMultiline = errors.New("chatclient: text must not contain newlines")
+)
+
+// Conn is a joined chat session. Next must be called from a single
+// goroutine, while sending is safe from any number of them.
+type Conn struct {
+	conn  net.Conn
+	lines *bufio.Scanner
+
+	writeLock sync.Mutex
+
+	nameLock sync.Mutex
+	username string
+
+	// Other members of the room at the time of joining.
+	Members []string
+}
+
+// Dial connects to the server at `address` and joins as `username`.
+func Dial(address, username string) (*Conn, error) {
+	return DialWithPassword(address, username, "")
+}
+
+// DialWithPassword is like Dial, but logs in with `password` if the server
+// asks for one because `username` is registered.
+func DialWithPassword(address, username, password string) (*Conn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := NewConnWithPassword(conn, username, password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewConn joins as `username` over an already established connection. The
+// connection is not closed if the handshake fails.
+func NewConn(conn net.Conn, username string) (*Conn, error) {
+	return NewConnWithPassword(conn, username, "")
+}
+
+// NewConnWithPassword is like NewConn, but logs in with `password` if the
+// server asks for one because `username` is registered.
+func NewConnWithPassword(conn net.Conn, username, password string) (*Conn, error) {
+	lines := bufio.NewScanner(conn)
+	lines.Buffer(nil, MaxLineLength)
+
+	c := &Conn{
+		conn:     conn,
+		lines:    lines,
+		username: username,
+	}
+
+	// The server may turn us away before even asking for a name
+	prompt, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(prompt, systemPrefix) {
+		return nil, rejected(prompt)
+	}
+
+	if err := c.writeLine(username); err != nil {
+		return nil, err
+	}
+
+	reply, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if reply == passwordPrompt {
+		if password == "" {
+			return nil, ErrPasswordRequired
+		}
+		if err := c.writeLine(password); err != nil {
+			return nil, err
+		}
+
+		if reply, err = c.readLine(); err != nil {
+			return nil, err
+		}
+	}
+
+	members, ok := Parse(reply).(Members)
+	if !ok {
+		return nil, rejected(reply)
+	}
+	c.Members = members.Names
+
+	return c, nil
+}
+
+func rejected(reason string) error {
+	return fmt.Errorf("%w: %s", ErrRejected, strings.TrimPrefix(reason, systemPrefix))
+}
+
+func (c *Conn) readLine() (string, error) {
+	if !c.lines.Scan() {
+		if err := c.lines.Err(); err != nil {
+			return "", err
+		}
+		return "", net.ErrClosed
+	}
+	return c.lines.Text(), nil
+}
+
+func (c *Conn) writeLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return ErrMultiline
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// Next waits for the next line from the server and parses it. Returns
+// net.ErrClosed once the server hangs up.
+func (c *Conn) Next() (Event, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	ev := Parse(line)
+	if notice, ok := ev.(Notice); ok {
+		if name, ok := strings.CutPrefix(notice.Text, renamedPrefix); ok {
+			c.nameLock.Lock()
+			c.username = name
+			c.nameLock.Unlock()
+		}
+	}
+	return ev, nil
+}
+
+// Current name of the user, following successful renames seen by Next.
+func (c *Conn) Username() string {
+	c.nameLock.Lock()
+	defer c.nameLock.Unlock()
+
+	return c.username
+}
+
+// Send `text` to the current room. Text starting with a slash is run as a
+// command by the server.
+func (c *Conn) Send(text string) error {
+	return c.writeLine(text)
+}
+
+// Move to `room`, creating it if needed. The server replies with Members.
+func (c *Conn) Join(room string) error {
+	return c.writeLine("/join " + room)
+}
+
+// Go back to the default room.
+func (c *Conn) Part() error {
+	return c.writeLine("/part")
+}
+
+// Send `text` privately to `username`.
+func (c *Conn) Tell(username, text string) error {
+	return c.writeLine("/msg " + username + " " + text)
+}
+
+// Change the user's name.
+func (c *Conn) Nick(username string) error {
+	return c.writeLine("/nick " + username)
+}
+
+// Ask for the list of rooms. The server replies with Rooms.
+func (c *Conn) ListRooms() error {
+	return c.writeLine("/rooms")
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,153 @@
+package chatclient
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/accounts"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/server"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		give string
+		want Event
+	}{
+		{give: "* This room contains: bob, carol", want: Members{Names: []string{"bob", "carol"}}},
+		{give: "* This room is empty", want: Members{Names: []string{}}},
+		{give: "* bob has entered the room", want: Joined{User: "bob"}},
+		{give: "* bob has left the room", want: Left{User: "bob"}},
+		{give: "* bob is now known as robert", want: Renamed{From: "bob", To: "robert"}},
+		{give: "* Rooms: lobby (2), go-dev (1)", want: Rooms{Rooms: []Room{{Name: "lobby", Members: 2}, {Name: "go-dev", Members: 1}}}},
+		{give: "* Rooms: lobby (many)", want: Notice{Text: "Rooms: lobby (many)"}},
+		{give: "* You are muted", want: Notice{Text: "You are muted"}},
+		{give: "* Username bob is already taken", want: Notice{Text: "Username bob is already taken"}},
+		{give: "[bob] hello [world]", want: Message{From: "bob", Text: "hello [world]"}},
+		{give: "[bob] ", want: Message{From: "bob", Text: ""}},
+		{give: "(mention) [bob] hi @alice", want: Message{From: "bob", Text: "hi @alice", Mention: true}},
+		{give: "[bob -> alice] psst", want: Direct{From: "bob", To: "alice", Text: "psst"}},
+		{give: "[not a name] hi", want: Text{Text: "[not a name] hi"}},
+		{give: "Welcome!", want: Text{Text: "Welcome!"}},
+	}
+
+	for _, test := range tests {
+		if have := Parse(test.give); !reflect.DeepEqual(have, test.want) {
+			t.Errorf("%q: want %#v have %#v", test.give, test.want, have)
+		}
+	}
+}
+
+func join(t *testing.T, srv *server.Server, username string) (*Conn, error) {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	remote.SetDeadline(time.Now().Add(time.Second))
+	go srv.Attach(local, server.HandleClient)
+
+	return NewConn(remote, username)
+}
+
+func TestConn(t *testing.T) {
+	srv := server.NewServer()
+	srv.MarkMentions = true
+
+	alice, err := join(t, srv, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alice.Members) != 0 {
+		t.Errorf("want no members have %v", alice.Members)
+	}
+
+	bob, err := join(t, srv, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bob.Members, []string{"alice"}) {
+		t.Errorf("want [alice] have %v", bob.Members)
+	}
+
+	if _, err := join(t, srv, "bob"); !errors.Is(err, ErrRejected) {
+		t.Errorf("want %v have %v", ErrRejected, err)
+	}
+
+	expect := func(c *Conn, want Event) {
+		t.Helper()
+
+		have, err := c.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("want %#v have %#v", want, have)
+		}
+	}
+
+	expect(alice, Joined{User: "bob"})
+
+	go bob.Send("hi @alice")
+	expect(alice, Message{From: "bob", Text: "hi @alice", Mention: true})
+
+	go alice.Tell("bob", "psst")
+	expect(bob, Direct{From: "alice", To: "bob", Text: "psst"})
+
+	go alice.Nick("al")
+	expect(alice, Notice{Text: "You are now known as al"})
+	if name := alice.Username(); name != "al" {
+		t.Errorf("want al have %s", name)
+	}
+	expect(bob, Renamed{From: "alice", To: "al"})
+
+	go bob.Join("den")
+	expect(bob, Members{Names: []string{}})
+	expect(alice, Left{User: "bob"})
+
+	go bob.ListRooms()
+	expect(bob, Rooms{Rooms: []Room{{Name: "den", Members: 1}, {Name: server.DefaultRoom, Members: 1}}})
+
+	if err := alice.Send("one\ntwo"); err != ErrMultiline {
+		t.Errorf("want %v have %v", ErrMultiline, err)
+	}
+
+	go bob.Part()
+	expect(bob, Members{Names: []string{"al"}})
+	expect(alice, Joined{User: "bob"})
+}
+
+func TestConnWithPassword(t *testing.T) {
+	store, err := accounts.Open(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Register("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := server.NewServer()
+	srv.Accounts = store
+
+	tests := []struct {
+		password string
+		want     error
+	}{
+		{password: "", want: ErrPasswordRequired},
+		{password: "wrong", want: ErrRejected},
+		{password: "secret", want: nil},
+	}
+
+	for _, test := range tests {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		remote.SetDeadline(time.Now().Add(time.Second))
+		go srv.Attach(local, server.HandleClient)
+
+		if _, err := NewConnWithPassword(remote, "alice", test.password); !errors.Is(err, test.want) {
+			t.Errorf("%q: want %v have %v", test.password, test.want, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package chatclient
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Event is a line received from the server, parsed into one of the types
+// below. Lines that don't match any known format become Notice or Text.
+type Event interface {
+	event()
+}
+
+// Members of the room the user just entered, sent right after joining.
+type Members struct {
+	Names []string
+}
+
+// User entered the current room.
+type Joined struct {
+	User string
+}
+
+// User left the current room.
+type Left struct {
+	User string
+}
+
+// User changed their name.
+type Renamed struct {
+	From string
+	To   string
+}
+
+// Message sent to the room. Mention is set if it mentions the user, which
+// servers only mark with -mark-mentions.
+type Message struct {
+	From    string
+	Text    string
+	Mention bool
+}
+
+// Direct message between two users, one of which is the user.
+type Direct struct {
+	From string
+	To   string
+	Text string
+}
+
+// Room as shown by the /rooms command.
+type Room struct {
+	Name    string
+	Members int
+}
+
+// Reply to the /rooms command.
+type Rooms struct {
+	Rooms []Room
+}
+
+// Any other system line, without the leading "* ".
+type Notice struct {
+	Text string
+}
+
+// Line in no known format.
+type Text struct {
+	Text string
+}
+
+func (Members) event() {}
+func (Joined) event()  {}
+func (Left) event()    {}
+func (Renamed) event() {}
+func (Message) event() {}
+func (Direct) event()  {}
+func (Rooms) event()   {}
+func (Notice) event()  {}
+func (Text) event()    {}
+
+const (
+	systemPrefix  = "* "
+	mentionPrefix = "(mention) "
+	roomsPrefix   = "Rooms: "
+	membersPrefix = "This room contains: "
+	emptyRoom     = "This room is empty"
+	renamedPrefix = "You are now known as "
+
+	passwordPrompt = "This username is registered, what's the password?"
+)
+
+// Usernames and room names never contain spaces, which tells them apart from
+// free-form notices.
+func isName(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " ,")
+}
+
+// Parse a line received from the server, without the trailing newline.
+func Parse(line string) Event {
+	if text, ok := strings.CutPrefix(line, systemPrefix); ok {
+		return parseSystem(text)
+	}
+
+	text, mention := strings.CutPrefix(line, mentionPrefix)
+	if rest, ok := strings.CutPrefix(text, "["); ok {
+		if header, body, ok := strings.Cut(rest, "] "); ok {
+			if from, to, ok := strings.Cut(header, " -> "); ok && !mention && isName(from) && isName(to) {
+				return Direct{From: from, To: to, Text: body}
+			}
+			if isName(header) {
+				return Message{From: header, Text: body, Mention: mention}
+			}
+		}
+	}
+
+	return Text{Text: line}
+}
+
+func parseSystem(text string) Event {
+	if text == emptyRoom {
+		return Members{Names: []string{}}
+	}
+	if names, ok := strings.CutPrefix(text, membersPrefix); ok {
+		return Members{Names: strings.Split(names, ", ")}
+	}
+	if list, ok := strings.CutPrefix(text, roomsPrefix); ok {
+		if rooms, ok := parseRooms(list); ok {
+			return Rooms{Rooms: rooms}
+		}
+	}
+
+	if user, ok := strings.CutSuffix(text, " has entered the room"); ok && isName(user) {
+		return Joined{User: user}
+	}
+	if user, ok := strings.CutSuffix(text, " has left the room"); ok && isName(user) {
+		return Left{User: user}
+	}
+	if from, to, ok := strings.Cut(text, " is now known as "); ok && isName(from) && isName(to) {
+		return Renamed{From: from, To: to}
+	}
+
+	return Notice{Text: text}
+}
+
+// Parse "name (count), ..." as sent by /rooms.
+func parseRooms(list string) ([]Room, bool) {
+	rooms := []Room{}
+	if list == "" {
+		return rooms, true
+	}
+
+	for _, entry := range strings.Split(list, ", ") {
+		name, count, ok := strings.Cut(entry, " (")
+		if !ok || !isName(name) {
+			return nil, false
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(count, ")"))
+		if err != nil || !strings.HasSuffix(count, ")") {
+			return nil, false
+		}
+		rooms = append(rooms, Room{Name: name, Members: n})
+	}
+
+	return rooms, true
+}
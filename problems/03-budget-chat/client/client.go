@@ -2,54 +2,195 @@ package client
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 const (
 	clientWriteTimeout = time.Second * 5
+
+	// Default number of outgoing messages a client may have pending.
+	DefaultQueueSize = 64
+
+	// Default length of the longest line a client may send, not counting
+	// the newline.
+	DefaultMaxLineLength = 64 * 1024
+)
+
+var (
+	ErrQueueFull   = errors.New("client: send queue full")
+	ErrClosed      = errors.New("client: closed")
+	ErrLineTooLong = errors.New("client: line too long")
 )
 
 type Client struct {
 	// Client's underlying TCP connection.
 	conn net.Conn
 
-	// Protocol specifies that all messages are '\n' terminated
-	// so we can use a scanner for reading.
-	scanner *bufio.Scanner
+	// Protocol specifies that all messages are '\n' terminated.
+	reader *bufio.Reader
+
+	// Outgoing messages. A single writer goroutine drains the queue,
+	// so messages are delivered in the order they were queued.
+	queue     chan []byte
+	queueLock sync.Mutex
+	closed    bool
+
+	// Closed once the writer goroutine has exited.
+	done chan struct{}
 
 	// Client's username. Empty string indicates that they have not joined yet.
-	Username string
+	username     string
+	usernameLock sync.RWMutex
+
+	// Join time, activity and away status, see Presence.
+	presence     Presence
+	presenceLock sync.Mutex
+
+	// Longest line Read accepts, DefaultMaxLineLength if zero. Must be set
+	// before the first Read.
+	MaxLineLength int
 }
 
 func NewClient(conn net.Conn) *Client {
-	return &Client{
-		conn:    conn,
-		scanner: bufio.NewScanner(conn),
+	return NewClientWithQueue(conn, DefaultQueueSize)
+}
+
+// Create a client that may have at most `size` outgoing messages pending,
+// DefaultQueueSize if it isn't positive.
+func NewClientWithQueue(conn net.Conn, size int) *Client {
+	if size < 1 {
+		size = DefaultQueueSize
+	}
+
+	c := &Client{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		queue:  make(chan []byte, size),
+		done:   make(chan struct{}),
 	}
+	c.presence.LastActive = time.Now()
+
+	go c.writeLoop()
+
+	return c
+}
+
+// Client's username, empty if they have not joined yet.
+func (c *Client) Username() string {
+	c.usernameLock.RLock()
+	defer c.usernameLock.RUnlock()
+
+	return c.username
+}
+
+// Change the client's username. Safe to call while other goroutines read it,
+// keeping names unique is up to the caller.
+func (c *Client) SetUsername(username string) {
+	c.usernameLock.Lock()
+	defer c.usernameLock.Unlock()
+
+	c.username = username
 }
 
 func (c *Client) Joined() bool {
-	return c.Username != ""
+	return c.Username() != ""
+}
+
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
 }
 
+// Queue `data` for delivery without blocking. A client that lets its queue
+// fill up is too slow to keep up with the chat: it is evicted by closing
+// its connection and ErrQueueFull is returned.
 func (c *Client) Write(data []byte) error {
-	c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
-	_, err := c.conn.Write(data)
-	return err
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	select {
+	case c.queue <- data:
+		return nil
+	default:
+		c.closed = true
+		close(c.queue)
+		c.conn.Close()
+		return ErrQueueFull
+	}
 }
 
+func (c *Client) writeLoop() {
+	defer close(c.done)
+
+	for data := range c.queue {
+		c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+		if _, err := c.conn.Write(data); err != nil {
+			// Connection is unusable, discard whatever is left.
+			c.conn.Close()
+			for range c.queue {
+			}
+			return
+		}
+	}
+}
+
+// Deliver pending messages and close the connection.
+func (c *Client) Close() error {
+	c.queueLock.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.queueLock.Unlock()
+
+	<-c.done
+
+	return c.conn.Close()
+}
+
+// Read the next line sent by the client, without the line ending. A line
+// longer than MaxLineLength is skipped and ErrLineTooLong is returned, the
+// client may carry on with the next one.
 func (c *Client) Read() ([]byte, error) {
-	if !c.scanner.Scan() {
-		err := c.scanner.Err()
-		if err == nil {
-			err = io.EOF
+	limit := c.MaxLineLength
+	if limit <= 0 {
+		limit = DefaultMaxLineLength
+	}
+
+	var line []byte
+	tooLong := false
+
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			// Leave room for the line ending, it's trimmed below
+			tooLong = len(line) > limit+2
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
 		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		break
+	}
 
-		return nil, err
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if tooLong || len(line) > limit {
+		return nil, ErrLineTooLong
 	}
-	return c.scanner.Bytes(), nil
+	return line, nil
 }
 
 type Message struct {
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteOrdering(t *testing.T) {
+	local, remote := net.Pipe()
+
+	const (
+		writers = 8
+		count   = 1000
+	)
+
+	c := NewClientWithQueue(local, writers*count)
+
+	// Slow reader, so that messages pile up in the queue
+	received := make(chan []string)
+	go func() {
+		lines := []string{}
+		scanner := bufio.NewScanner(remote)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+			if len(lines)%100 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		received <- lines
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				if err := c.Write([]byte(fmt.Sprintf("%d %d\n", w, i))); err != nil {
+					t.Errorf("writer %d: write %d: %s", w, i, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := <-received
+	if len(lines) != writers*count {
+		t.Fatalf("want %d lines have %d", writers*count, len(lines))
+	}
+
+	// Messages from every writer arrive in the order they were written
+	next := make([]int, writers)
+	for _, line := range lines {
+		var w, i int
+		if _, err := fmt.Sscanf(line, "%d %d", &w, &i); err != nil {
+			t.Fatal(err)
+		}
+		if i != next[w] {
+			t.Fatalf("writer %d: want %d have %d", w, next[w], i)
+		}
+		next[w]++
+	}
+}
+
+func TestWriteOverflow(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	// Nobody reads from `remote`, so the writer goroutine stalls
+	c := NewClientWithQueue(local, 2)
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = c.Write([]byte("hello\n"))
+	}
+
+	if err != ErrQueueFull {
+		t.Fatalf("want %v have %v", ErrQueueFull, err)
+	}
+
+	if err := c.Write([]byte("hello\n")); err != ErrClosed {
+		t.Fatalf("want %v have %v", ErrClosed, err)
+	}
+
+	// Evicted client's connection is closed
+	if _, err := c.Read(); err == nil {
+		t.Fatal("expected read from evicted client to fail")
+	}
+
+	c.Close()
+}
+
+func TestQueueSize(t *testing.T) {
+	tests := []struct {
+		give int
+		want int
+	}{
+		{give: 1, want: 1},
+		{give: 128, want: 128},
+		{give: 0, want: DefaultQueueSize},
+		{give: -1, want: DefaultQueueSize},
+	}
+
+	for _, test := range tests {
+		local, remote := net.Pipe()
+		c := NewClientWithQueue(local, test.give)
+		if size := cap(c.queue); size != test.want {
+			t.Errorf("%d: want %d have %d", test.give, test.want, size)
+		}
+		remote.Close()
+		c.Close()
+	}
+}
+
+func TestReadMaxLineLength(t *testing.T) {
+	local, remote := net.Pipe()
+	c := NewClient(local)
+	c.MaxLineLength = 8
+	defer c.Close()
+
+	go func() {
+		remote.Write([]byte("short\r\n12345678\n" + strings.Repeat("x", 10000) + "\nafter\nlast"))
+		remote.Close()
+	}()
+
+	tests := []struct {
+		want string
+		err  error
+	}{
+		{want: "short"},
+		{want: "12345678"},
+		{err: ErrLineTooLong},
+		{want: "after"},
+		{want: "last"},
+		{err: io.EOF},
+	}
+
+	for i, test := range tests {
+		line, err := c.Read()
+		if err != test.err {
+			t.Fatalf("%d: want %v have %v", i, test.err, err)
+		}
+		if string(line) != test.want {
+			t.Errorf("%d: want %q have %q", i, test.want, line)
+		}
+	}
+}
+
+func TestPresence(t *testing.T) {
+	local, _ := net.Pipe()
+	c := NewClient(local)
+	defer c.Close()
+
+	if p := c.Presence(); !p.JoinedAt.IsZero() || p.LastActive.IsZero() {
+		t.Errorf("unexpected presence before joining: %+v", p)
+	}
+
+	c.MarkJoined()
+	joined := c.Presence().JoinedAt
+	if joined.IsZero() {
+		t.Error("want join time")
+	}
+
+	time.Sleep(time.Millisecond)
+	c.Touch()
+	if p := c.Presence(); !p.LastActive.After(joined) || p.JoinedAt != joined {
+		t.Errorf("want activity after %v have %+v", joined, p)
+	}
+	if idle := c.Presence().Idle(c.Presence().LastActive.Add(-time.Second)); idle != 0 {
+		t.Errorf("want 0 have %v", idle)
+	}
+
+	c.SetAway("lunch")
+	if away := c.Presence().Away; away != "lunch" {
+		t.Errorf("want lunch have %q", away)
+	}
+}
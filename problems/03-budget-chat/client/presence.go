@@ -0,0 +1,55 @@
+package client
+
+import "time"
+
+// Presence details of a user, as shown by /who.
+type Presence struct {
+	// When the user joined the chat, zero if they haven't yet.
+	JoinedAt time.Time
+
+	// When the user last sent anything.
+	LastActive time.Time
+
+	// Away message, empty if the user is not away.
+	Away string
+}
+
+// How long the user has been inactive at `now`.
+func (p Presence) Idle(now time.Time) time.Duration {
+	if idle := now.Sub(p.LastActive); idle > 0 {
+		return idle
+	}
+	return 0
+}
+
+// Record that the user joined the chat just now.
+func (c *Client) MarkJoined() {
+	c.presenceLock.Lock()
+	defer c.presenceLock.Unlock()
+
+	c.presence.JoinedAt = time.Now()
+	c.presence.LastActive = c.presence.JoinedAt
+}
+
+// Record activity by the user, resetting their idle time.
+func (c *Client) Touch() {
+	c.presenceLock.Lock()
+	defer c.presenceLock.Unlock()
+
+	c.presence.LastActive = time.Now()
+}
+
+// Mark the user as away with `message`, or as back if it is empty.
+func (c *Client) SetAway(message string) {
+	c.presenceLock.Lock()
+	defer c.presenceLock.Unlock()
+
+	c.presence.Away = message
+}
+
+func (c *Client) Presence() Presence {
+	c.presenceLock.Lock()
+	defer c.presenceLock.Unlock()
+
+	return c.presence
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Address of a client that is not backed by a network connection.
+type VirtualAddr string
+
+func (a VirtualAddr) Network() string {
+	return "virtual"
+}
+
+func (a VirtualAddr) String() string {
+	return string(a)
+}
+
+// Connection that discards everything written to it. Reads block until
+// it is closed.
+type virtualConn struct {
+	addr      VirtualAddr
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *virtualConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *virtualConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+		return len(p), nil
+	}
+}
+
+func (c *virtualConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *virtualConn) LocalAddr() net.Addr                { return c.addr }
+func (c *virtualConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *virtualConn) SetDeadline(t time.Time) error      { return nil }
+func (c *virtualConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *virtualConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// NewVirtual creates a client without a connection, such as a user joined
+// through another server. Everything written to it is discarded.
+func NewVirtual(addr string) *Client {
+	return NewClient(&virtualConn{
+		addr:   VirtualAddr(addr),
+		closed: make(chan struct{}),
+	})
+}
@@ -0,0 +1,134 @@
+// Command chat is a terminal client for budget-chat.
+//
+// Lines typed on standard input are sent to the current room, and chat
+// commands such as /join, /msg or /nick are passed through to the server.
+// Type /quit or press Ctrl-D to leave.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/chatclient"
+)
+
+const (
+	bold  = "\x1b[1m"
+	dim   = "\x1b[2m"
+	reset = "\x1b[0m"
+)
+
+type printer struct {
+	color bool
+}
+
+func (p printer) style(style, text string) string {
+	if !p.color {
+		return text
+	}
+	return style + text + reset
+}
+
+func (p printer) print(text string) {
+	stamp := time.Now().Format("15:04")
+	fmt.Printf("%s %s\n", p.style(dim, stamp), text)
+}
+
+func (p printer) members(names []string) {
+	if len(names) == 0 {
+		p.print(p.style(dim, "* Nobody else is here"))
+		return
+	}
+	p.print(p.style(dim, "* Here: "+strings.Join(names, ", ")))
+}
+
+func (p printer) event(ev chatclient.Event) {
+	switch ev := ev.(type) {
+	case chatclient.Members:
+		p.members(ev.Names)
+	case chatclient.Joined:
+		p.print(p.style(dim, "--> "+ev.User+" joined"))
+	case chatclient.Left:
+		p.print(p.style(dim, "<-- "+ev.User+" left"))
+	case chatclient.Renamed:
+		p.print(p.style(dim, "--- "+ev.From+" is now known as "+ev.To))
+	case chatclient.Message:
+		line := "<" + ev.From + "> " + ev.Text
+		if ev.Mention {
+			line = p.style(bold, line)
+		}
+		p.print(line)
+	case chatclient.Direct:
+		p.print(p.style(bold, "["+ev.From+" -> "+ev.To+"] "+ev.Text))
+	case chatclient.Rooms:
+		for _, r := range ev.Rooms {
+			p.print(p.style(dim, fmt.Sprintf("* %s (%d)", r.Name, r.Members)))
+		}
+	case chatclient.Notice:
+		p.print(p.style(dim, "* "+ev.Text))
+	case chatclient.Text:
+		p.print(ev.Text)
+	}
+}
+
+func main() {
+	address := flag.String("addr", "127.0.0.1:10000", "address of the chat server")
+	username := flag.String("name", "", "username to join as (asked for if empty)")
+	password := flag.String("password", "", "password of the username, if it is registered")
+	color := flag.Bool("color", true, "highlight mentions and system lines")
+	flag.Parse()
+
+	input := bufio.NewScanner(os.Stdin)
+	if *username == "" {
+		fmt.Print("Username: ")
+		if !input.Scan() {
+			return
+		}
+		*username = strings.TrimSpace(input.Text())
+	}
+
+	conn, err := chatclient.DialWithPassword(*address, *username, *password)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	p := printer{color: *color}
+	p.members(conn.Members)
+
+	go func() {
+		for {
+			ev, err := conn.Next()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Print(err)
+				}
+				p.print(p.style(dim, "* Disconnected"))
+				os.Exit(0)
+			}
+			p.event(ev)
+		}
+	}()
+
+	for input.Scan() {
+		line := input.Text()
+		if line == "/quit" {
+			return
+		}
+		if err := conn.Send(line); err != nil {
+			log.Fatal(err)
+		}
+
+		// The server doesn't echo messages back to their sender
+		if !strings.HasPrefix(line, "/") {
+			p.print("<" + conn.Username() + "> " + line)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Command replay plays a budget-chat transcript back into a fresh server.
+//
+// Every user in the transcript gets their own TCP connection, over which the
+// recorded joins, room changes, renames, messages and departures are redone in
+// the original order. The transcript is read from the files given as
+// arguments, oldest first, or from standard input. Connect to -addr with any
+// chat client to watch the replay.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/server"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/transcript"
+)
+
+// Connection of a single replayed user.
+type session struct {
+	conn net.Conn
+}
+
+func dial(address, username string, verbose bool) (*session, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep reading so the server never evicts us as a slow consumer
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			if verbose {
+				log.Printf("%s <- %s\n", username, scanner.Text())
+			}
+		}
+	}()
+
+	s := &session{conn: conn}
+	if err := s.send(username); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *session) send(line string) error {
+	_, err := s.conn.Write([]byte(line + "\n"))
+	return err
+}
+
+type replayer struct {
+	address  string
+	sessions map[string]*session
+	verbose  bool
+}
+
+func (r *replayer) apply(ev transcript.Event) error {
+	s := r.sessions[ev.User]
+
+	switch ev.Type {
+	case transcript.Join:
+		if s == nil {
+			// Clients always enter the default room first
+			s, err := dial(r.address, ev.User, r.verbose)
+			if err != nil {
+				return err
+			}
+			r.sessions[ev.User] = s
+			return nil
+		}
+		if ev.Room == server.DefaultRoom {
+			return s.send(server.CommandPrefix + "part")
+		}
+		return s.send(server.CommandPrefix + "join " + ev.Room)
+	case transcript.Rename:
+		if s == nil {
+			return nil
+		}
+		delete(r.sessions, ev.User)
+		r.sessions[ev.Text] = s
+		return s.send(server.CommandPrefix + "nick " + ev.Text)
+	case transcript.Message:
+		if s == nil {
+			return nil
+		}
+		return s.send(ev.Text)
+	case transcript.Quit:
+		if s == nil {
+			return nil
+		}
+		delete(r.sessions, ev.User)
+		return s.conn.Close()
+	}
+
+	// Leaving a room is implied by the join or quit that follows
+	return nil
+}
+
+func (r *replayer) close() {
+	for username, s := range r.sessions {
+		s.conn.Close()
+		delete(r.sessions, username)
+	}
+}
+
+// Replay all events from `src`, pacing them by `speed` times their original
+// interval but at least `gap` apart, so that the server sees them in order.
+func (r *replayer) run(src io.Reader, speed float64, gap time.Duration, last *time.Time) error {
+	events := transcript.NewReader(src)
+
+	for {
+		ev, err := events.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		wait := gap
+		if speed > 0 && !last.IsZero() {
+			if d := time.Duration(float64(ev.Time.Sub(*last)) / speed); d > wait {
+				wait = d
+			}
+		}
+		*last = ev.Time
+		time.Sleep(wait)
+
+		if r.verbose {
+			log.Printf("%s %s %s %s\n", ev.Type, ev.Room, ev.User, ev.Text)
+		}
+
+		if err := r.apply(ev); err != nil {
+			return err
+		}
+	}
+}
+
+func main() {
+	address := flag.String("addr", "127.0.0.1:10000", "address the fresh server listens on")
+	target := flag.String("target", "", "replay into an already running server at this address instead")
+	speed := flag.Float64("speed", 0, "replay speed relative to the recording (0 to replay as fast as possible)")
+	gap := flag.Duration("gap", 10*time.Millisecond, "minimum delay between events")
+	keep := flag.Bool("keep", false, "keep the server running after the replay until interrupted")
+	verbose := flag.Bool("v", false, "log replayed events and what the server sends back")
+	flag.Parse()
+
+	var srv *server.Server
+	if *target == "" {
+		ln, err := net.Listen("tcp", *address)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		srv = server.NewServer()
+		go func() {
+			if err := srv.Serve(ln, server.HandleClient); err != server.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+
+		*target = ln.Addr().String()
+		log.Printf("Replaying into a fresh server on %s\n", *target)
+	}
+
+	r := &replayer{
+		address:  *target,
+		sessions: map[string]*session{},
+		verbose:  *verbose,
+	}
+
+	var last time.Time
+	if flag.NArg() == 0 {
+		if err := r.run(os.Stdin, *speed, *gap, &last); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, path := range flag.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = r.run(f, *speed, *gap, &last)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %s", path, err)
+		}
+	}
+
+	log.Println("Replay finished")
+
+	if *keep {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+	} else {
+		// Let the server relay the last events before disconnecting everyone
+		time.Sleep(*gap)
+	}
+	r.close()
+
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("ERROR: Shutdown failed: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,589 @@
+// Package irc lets ordinary IRC clients join budget-chat.
+//
+// Conn translates between the core of the IRC client protocol (PASS, NICK,
+// USER, JOIN, PART, PRIVMSG, NAMES, PING/PONG and QUIT) and the line based
+// budget-chat protocol, so an IRC connection can be attached to a
+// server.Server like any TCP client. Chat rooms are exposed as channels of
+// the same name prefixed with '#'.
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/server"
+)
+
+// Name the gateway uses as the prefix of server messages.
+const ServerName = "budgetchat"
+
+const (
+	rplWelcome          = "001"
+	rplYourHost         = "002"
+	rplNamReply         = "353"
+	rplEndOfNames       = "366"
+	errNoSuchNick       = "401"
+	errUnknownCommand   = "421"
+	errNoMOTD           = "422"
+	errNoNicknameGiven  = "431"
+	errErroneusNick     = "432"
+	errNicknameInUse    = "433"
+	errNotOnChannel     = "442"
+	errNeedMoreParams   = "461"
+	errAlreadyRegistred = "462"
+	errPasswdMismatch   = "464"
+)
+
+var errPasswordRequired = errors.New("irc: registered nickname used without PASS")
+
+// Split an IRC line into its command and parameters, dropping the prefix.
+func parseLine(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	params := []string{}
+	for line != "" {
+		if strings.HasPrefix(line, ":") {
+			params = append(params, line[1:])
+			break
+		}
+
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+
+	if len(params) == 0 {
+		return "", nil
+	}
+
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+func channelName(room string) string {
+	return "#" + room
+}
+
+// Conn adapts an IRC client connection to the budget-chat protocol.
+type Conn struct {
+	net.Conn
+
+	r *bufio.Reader
+
+	// Chat lines produced from IRC commands, not yet consumed by Read
+	pending []byte
+
+	// Partial chat line written without a trailing newline yet
+	partial []byte
+
+	writeLock sync.Mutex
+
+	// Session state shared by the reading and writing sides
+	stateLock  sync.Mutex
+	nick       string
+	user       bool
+	registered bool
+
+	// Password from PASS, answered when the chat asks for one
+	password string
+
+	// Whether the nickname was already sent to the server as username
+	picked bool
+
+	// Whether the chat's reaction to the nickname hasn't been seen by Read
+	// yet, and the channel telling it whether a password was asked for
+	awaiting bool
+	verdict  chan bool
+	closed   chan struct{}
+	closeErr error
+	closing  sync.Once
+
+	// Whether the chat turned the nickname down. The connection then
+	// outlives the chat session, so the client can pick another one.
+	rejected bool
+
+	room     string
+	nextRoom string
+	members  []string
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Conn:     conn,
+		r:        bufio.NewReader(conn),
+		nextRoom: server.DefaultRoom,
+		verdict:  make(chan bool, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Send a raw IRC line.
+func (c *Conn) send(line string) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.Conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// Send a numeric reply addressed to the client.
+func (c *Conn) reply(numeric string, params ...string) error {
+	c.stateLock.Lock()
+	nick := c.nick
+	c.stateLock.Unlock()
+
+	if nick == "" {
+		nick = "*"
+	}
+
+	return c.send(":" + ServerName + " " + numeric + " " + nick + " " + strings.Join(params, " "))
+}
+
+// Full prefix for messages originating from `nick`.
+func userPrefix(nick string) string {
+	return ":" + nick + "!" + nick + "@" + ServerName
+}
+
+// Read returns chat lines translated from the client's IRC commands.
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.answerPrompt(); err != nil {
+		return 0, err
+	}
+
+	for len(c.pending) == 0 {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+
+		chat, err := c.handleCommand(parseLine(line))
+		if err != nil {
+			return 0, err
+		}
+		if chat != "" {
+			c.pending = append([]byte(chat), '\n')
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Once the nickname was sent, wait to see whether the chat asks for a
+// password and answer with the one from PASS.
+func (c *Conn) answerPrompt() error {
+	c.stateLock.Lock()
+	awaiting := c.awaiting
+	c.awaiting = false
+	verdict := c.verdict
+	password := c.password
+	c.stateLock.Unlock()
+
+	if !awaiting {
+		return nil
+	}
+
+	select {
+	case wanted := <-verdict:
+		if !wanted {
+			return nil
+		}
+		if password == "" {
+			return errPasswordRequired
+		}
+		c.pending = append([]byte(password), '\n')
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+// Tell Read whether the chat asked for a password.
+func (c *Conn) decide(wanted bool) {
+	c.stateLock.Lock()
+	verdict := c.verdict
+	c.stateLock.Unlock()
+
+	select {
+	case verdict <- wanted:
+	default:
+	}
+}
+
+// Handle a single IRC command, returning the chat line it maps to, if any.
+func (c *Conn) handleCommand(cmd string, params []string) (string, error) {
+	c.stateLock.Lock()
+	registered := c.registered
+	room := c.room
+	c.stateLock.Unlock()
+
+	switch cmd {
+	case "":
+		return "", nil
+	case "PING":
+		return "", c.send(":" + ServerName + " PONG " + ServerName + " :" + strings.Join(params, " "))
+	case "PONG", "MODE", "WHO", "USERHOST":
+		return "", nil
+	case "CAP":
+		return "", c.send(":" + ServerName + " CAP * LS :")
+	case "QUIT":
+		return "", io.EOF
+	case "PASS":
+		if registered {
+			return "", c.reply(errAlreadyRegistred, ":You may not reregister")
+		}
+		if len(params) == 0 {
+			return "", c.reply(errNeedMoreParams, "PASS", ":Not enough parameters")
+		}
+		c.stateLock.Lock()
+		c.password = params[0]
+		c.stateLock.Unlock()
+		return "", nil
+	case "NICK":
+		if len(params) == 0 {
+			return "", c.reply(errNoNicknameGiven, ":No nickname given")
+		}
+		if registered {
+			return server.CommandPrefix + "nick " + params[0], nil
+		}
+		c.stateLock.Lock()
+		c.nick = params[0]
+		c.stateLock.Unlock()
+		return c.register()
+	case "USER":
+		if len(params) < 4 {
+			return "", c.reply(errNeedMoreParams, "USER", ":Not enough parameters")
+		}
+		c.stateLock.Lock()
+		c.user = true
+		c.stateLock.Unlock()
+		return c.register()
+	}
+
+	if !registered {
+		// Nothing else makes sense before the chat accepted the nickname
+		return "", nil
+	}
+
+	switch cmd {
+	case "JOIN":
+		if len(params) == 0 {
+			return "", c.reply(errNeedMoreParams, "JOIN", ":Not enough parameters")
+		}
+		channel, _, _ := strings.Cut(params[0], ",")
+		room := strings.TrimPrefix(channel, "#")
+		c.expectRoom(room)
+		return server.CommandPrefix + "join " + room, nil
+	case "PART":
+		c.expectRoom(server.DefaultRoom)
+		return server.CommandPrefix + "part", nil
+	case "NAMES":
+		return "", c.sendNames()
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 {
+			return "", c.reply(errNeedMoreParams, cmd, ":Not enough parameters")
+		}
+		target, text := params[0], params[1]
+		if !strings.HasPrefix(target, "#") {
+			return server.CommandPrefix + "msg " + target + " " + text, nil
+		}
+		if target != channelName(room) {
+			return "", c.reply(errNotOnChannel, target, ":You're not on that channel")
+		}
+		return text, nil
+	default:
+		return "", c.reply(errUnknownCommand, cmd, ":Unknown command")
+	}
+}
+
+// Pick the nickname as username once both NICK and USER were received.
+func (c *Conn) register() (string, error) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.nick == "" || !c.user || c.picked {
+		return "", nil
+	}
+	c.picked = true
+	c.awaiting = true
+	return c.nick, nil
+}
+
+func (c *Conn) sendNames() error {
+	c.stateLock.Lock()
+	room := c.room
+	names := append([]string{c.nick}, c.members...)
+	c.stateLock.Unlock()
+
+	if err := c.reply(rplNamReply, "=", channelName(room), ":"+strings.Join(names, " ")); err != nil {
+		return err
+	}
+	return c.reply(rplEndOfNames, channelName(room), ":End of /NAMES list")
+}
+
+// Write translates chat lines sent by the server into IRC messages.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.partial = append(c.partial, p...)
+
+	for {
+		idx := bytes.IndexByte(c.partial, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := string(c.partial[:idx])
+		c.partial = c.partial[idx+1:]
+
+		if err := c.handleChatLine(line); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (c *Conn) handleChatLine(line string) error {
+	c.stateLock.Lock()
+	registered := c.registered
+	nick := c.nick
+	room := c.room
+	c.stateLock.Unlock()
+
+	if strings.HasPrefix(line, "* This room ") {
+		return c.enteredRoom(line)
+	}
+
+	if !registered {
+		return c.handleLoginLine(line, nick)
+	}
+
+	if text, ok := strings.CutPrefix(line, "* "); ok {
+		return c.handleNotice(text)
+	}
+
+	line = strings.TrimPrefix(line, server.MentionPrefix)
+	if header, text, ok := strings.Cut(line, "] "); ok && strings.HasPrefix(header, "[") {
+		sender, recipient, direct := strings.Cut(header[1:], " -> ")
+		if direct {
+			return c.send(userPrefix(sender) + " PRIVMSG " + recipient + " :" + text)
+		}
+		return c.send(userPrefix(sender) + " PRIVMSG " + channelName(room) + " :" + text)
+	}
+
+	return c.send(":" + ServerName + " NOTICE " + nick + " :" + line)
+}
+
+// Handle what the chat says before it let the client in.
+func (c *Conn) handleLoginLine(line, nick string) error {
+	if strings.HasPrefix(line, "Welcome to budgetchat") {
+		return nil
+	}
+
+	c.stateLock.Lock()
+	password := c.password
+	c.stateLock.Unlock()
+
+	if line == strings.TrimSuffix(server.PasswordPrompt, "\n") {
+		c.decide(true)
+		if password != "" {
+			return nil
+		}
+		c.reject()
+		return c.reply(errPasswdMismatch, ":Nickname is registered, send PASS before NICK")
+	}
+
+	// Anything else means the nickname was turned down, unless it already
+	// was and this is just the chat's explanation
+	c.decide(false)
+	if !c.reject() {
+		return nil
+	}
+
+	switch {
+	case strings.Contains(line, "already taken"):
+		return c.reply(errNicknameInUse, nick, ":Nickname is already in use")
+	case line == strings.TrimSuffix(server.WrongPasswordMessage, "\n"):
+		return c.reply(errPasswdMismatch, ":Password incorrect")
+	default:
+		return c.reply(errErroneusNick, nick, ":"+line)
+	}
+}
+
+// Mark the nickname as turned down. Returns false if it already was.
+func (c *Conn) reject() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.rejected {
+		return false
+	}
+	c.rejected = true
+	return true
+}
+
+// Handle the member list the server sends whenever the client enters a room.
+func (c *Conn) enteredRoom(line string) error {
+	members := []string{}
+	if list, ok := strings.CutPrefix(line, "* This room contains: "); ok {
+		members = strings.Split(list, ", ")
+	}
+
+	c.decide(false)
+
+	c.stateLock.Lock()
+	welcome := !c.registered
+	c.registered = true
+	previous := c.room
+	c.room = c.nextRoom
+	c.members = members
+	nick := c.nick
+	room := c.room
+	c.stateLock.Unlock()
+
+	if welcome {
+		if err := c.reply(rplWelcome, ":Welcome to budgetchat, "+nick); err != nil {
+			return err
+		}
+		if err := c.reply(rplYourHost, ":Your host is "+ServerName); err != nil {
+			return err
+		}
+		if err := c.reply(errNoMOTD, ":MOTD File is missing"); err != nil {
+			return err
+		}
+	}
+
+	if previous != "" {
+		if err := c.send(userPrefix(nick) + " PART " + channelName(previous)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.send(userPrefix(nick) + " JOIN " + channelName(room)); err != nil {
+		return err
+	}
+	return c.sendNames()
+}
+
+// Usernames never contain spaces or commas, which tells the notices about
+// them apart from free-form ones quoting user text, such as away replies.
+func isName(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " ,")
+}
+
+// Translate a system message.
+func (c *Conn) handleNotice(text string) error {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	channel := channelName(c.room)
+
+	if name, ok := strings.CutSuffix(text, " has entered the room"); ok && isName(name) {
+		c.members = append(c.members, name)
+		return c.send(userPrefix(name) + " JOIN " + channel)
+	}
+
+	if name, ok := strings.CutSuffix(text, " has left the room"); ok && isName(name) {
+		if idx := slices.Index(c.members, name); idx >= 0 {
+			c.members = slices.Delete(c.members, idx, idx+1)
+		}
+		return c.send(userPrefix(name) + " PART " + channel)
+	}
+
+	if previous, name, ok := strings.Cut(text, " is now known as "); ok && isName(previous) && isName(name) {
+		if idx := slices.Index(c.members, previous); idx >= 0 {
+			c.members[idx] = name
+		}
+		return c.send(userPrefix(previous) + " NICK :" + name)
+	}
+
+	if name, ok := strings.CutPrefix(text, "You are now known as "); ok && isName(name) {
+		previous := c.nick
+		c.nick = name
+		return c.send(userPrefix(previous) + " NICK :" + name)
+	}
+
+	if name, ok := strings.CutPrefix(text, "No such user: "); ok && isName(name) {
+		return c.send(":" + ServerName + " " + errNoSuchNick + " " + c.nick + " " + name + " :No such nick/channel")
+	}
+
+	return c.send(":" + ServerName + " NOTICE " + c.nick + " :" + text)
+}
+
+// Remember the room the client asked to enter, so that the member list the
+// server answers with can be attributed to the right channel.
+func (c *Conn) expectRoom(room string) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.nextRoom = room
+}
+
+// Close the connection, unless the chat merely turned the nickname down.
+func (c *Conn) Close() error {
+	c.stateLock.Lock()
+	rejected := c.rejected
+	c.stateLock.Unlock()
+
+	if rejected {
+		return nil
+	}
+
+	c.closing.Do(func() {
+		close(c.closed)
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// Get ready for another chat session if the last one ended with the
+// nickname turned down. The client's next NICK is sent as username.
+func (c *Conn) retry() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if !c.rejected {
+		return false
+	}
+	c.rejected = false
+	c.picked = false
+	c.awaiting = false
+	c.verdict = make(chan bool, 1)
+	return true
+}
+
+// Attach `c` to `srv` until the client is let in and leaves again, or gives
+// up trying nicknames.
+func serveConn(srv *server.Server, c *Conn, handler server.ClientHandler) {
+	for {
+		srv.Attach(c, handler)
+		if !c.retry() {
+			return
+		}
+	}
+}
+
+// Serve accepts IRC connections on `ln` and attaches them to `srv`.
+func Serve(ln net.Listener, srv *server.Server, handler server.ClientHandler) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		log.Printf("New IRC connection: %s\n", conn.RemoteAddr())
+
+		go serveConn(srv, NewConn(conn), handler)
+	}
+}
@@ -0,0 +1,283 @@
+package irc
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/accounts"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/server"
+)
+
+type testPeer struct {
+	conn  net.Conn
+	lines *bufio.Reader
+}
+
+// Connect to `srv` with the standard handler, speaking IRC if `wrap` returns
+// a *Conn.
+func attach(t *testing.T, srv *server.Server, wrap func(net.Conn) net.Conn) *testPeer {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	if conn, ok := wrap(local).(*Conn); ok {
+		go serveConn(srv, conn, server.HandleClient)
+	} else {
+		go srv.Attach(local, server.HandleClient)
+	}
+
+	return &testPeer{conn: remote, lines: bufio.NewReader(remote)}
+}
+
+func (p *testPeer) send(t *testing.T, line string) {
+	t.Helper()
+
+	p.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := p.conn.Write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p *testPeer) expect(t *testing.T, want string) {
+	t.Helper()
+
+	p.conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := p.lines.ReadString('\n')
+	if err != nil {
+		t.Fatalf("want %q: %s", want, err)
+	}
+	if line = strings.TrimRight(line, "\r\n"); line != want {
+		t.Fatalf("want %q have %q", want, line)
+	}
+}
+
+func ircConn(conn net.Conn) net.Conn {
+	return NewConn(conn)
+}
+
+func tcpConn(conn net.Conn) net.Conn {
+	return conn
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		give       string
+		wantCmd    string
+		wantParams []string
+	}{
+		{give: "NICK alice\r\n", wantCmd: "NICK", wantParams: []string{"alice"}},
+		{give: "USER alice 0 * :Alice Liddell", wantCmd: "USER", wantParams: []string{"alice", "0", "*", "Alice Liddell"}},
+		{give: ":alice PRIVMSG #lobby :hello there", wantCmd: "PRIVMSG", wantParams: []string{"#lobby", "hello there"}},
+		{give: "privmsg bob ::)", wantCmd: "PRIVMSG", wantParams: []string{"bob", ":)"}},
+		{give: "PING", wantCmd: "PING", wantParams: []string{}},
+		{give: "", wantCmd: "", wantParams: nil},
+	}
+
+	for _, test := range tests {
+		cmd, params := parseLine(test.give)
+		if cmd != test.wantCmd || !slices.Equal(params, test.wantParams) {
+			t.Errorf("%q: want %s %q have %s %q", test.give, test.wantCmd, test.wantParams, cmd, params)
+		}
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	srv := server.NewServer()
+
+	tcp := attach(t, srv, tcpConn)
+	tcp.expect(t, "Welcome to budgetchat! What shall I call you?")
+	tcp.send(t, "alice\n")
+	tcp.expect(t, "* This room is empty")
+
+	irc := attach(t, srv, ircConn)
+	irc.send(t, "NICK bob\r\n")
+	irc.send(t, "USER bob 0 * :Bob\r\n")
+	irc.expect(t, ":budgetchat 001 bob :Welcome to budgetchat, bob")
+	irc.expect(t, ":budgetchat 002 bob :Your host is budgetchat")
+	irc.expect(t, ":budgetchat 422 bob :MOTD File is missing")
+	irc.expect(t, ":bob!bob@budgetchat JOIN #lobby")
+	irc.expect(t, ":budgetchat 353 bob = #lobby :bob alice")
+	irc.expect(t, ":budgetchat 366 bob #lobby :End of /NAMES list")
+
+	tcp.expect(t, "* bob has entered the room")
+
+	irc.send(t, "PING :12345\r\n")
+	irc.expect(t, ":budgetchat PONG budgetchat :12345")
+
+	irc.send(t, "PRIVMSG #lobby :hi alice\r\n")
+	tcp.expect(t, "[bob] hi alice")
+
+	tcp.send(t, "hey @bob\n")
+	irc.expect(t, ":alice!alice@budgetchat PRIVMSG #lobby :hey @bob")
+
+	irc.send(t, "PRIVMSG alice :psst\r\n")
+	tcp.expect(t, "[bob -> alice] psst")
+
+	tcp.send(t, "/msg bob secret\n")
+	irc.expect(t, ":alice!alice@budgetchat PRIVMSG bob :secret")
+
+	irc.send(t, "PRIVMSG #elsewhere :hello?\r\n")
+	irc.expect(t, ":budgetchat 442 bob #elsewhere :You're not on that channel")
+
+	irc.send(t, "NAMES\r\n")
+	irc.expect(t, ":budgetchat 353 bob = #lobby :bob alice")
+	irc.expect(t, ":budgetchat 366 bob #lobby :End of /NAMES list")
+
+	irc.send(t, "QUIT :bye\r\n")
+	tcp.expect(t, "* bob has left the room")
+}
+
+func TestChannels(t *testing.T) {
+	srv := server.NewServer()
+
+	irc := attach(t, srv, ircConn)
+	irc.send(t, "NICK bob\r\nUSER bob 0 * :Bob\r\n")
+	for i := 0; i < 6; i++ {
+		irc.lines.ReadString('\n')
+	}
+
+	tcp := attach(t, srv, tcpConn)
+	tcp.expect(t, "Welcome to budgetchat! What shall I call you?")
+	tcp.send(t, "alice\n")
+	tcp.expect(t, "* This room contains: bob")
+	irc.expect(t, ":alice!alice@budgetchat JOIN #lobby")
+
+	tcp.send(t, "/join dev\n")
+	tcp.expect(t, "* This room is empty")
+	irc.expect(t, ":alice!alice@budgetchat PART #lobby")
+
+	irc.send(t, "JOIN #dev\r\n")
+	irc.expect(t, ":bob!bob@budgetchat PART #lobby")
+	irc.expect(t, ":bob!bob@budgetchat JOIN #dev")
+	irc.expect(t, ":budgetchat 353 bob = #dev :bob alice")
+	irc.expect(t, ":budgetchat 366 bob #dev :End of /NAMES list")
+	tcp.expect(t, "* bob has entered the room")
+
+	irc.send(t, "PRIVMSG #dev :in dev now\r\n")
+	tcp.expect(t, "[bob] in dev now")
+
+	irc.send(t, "NICK robert\r\n")
+	irc.expect(t, ":bob!bob@budgetchat NICK :robert")
+	tcp.expect(t, "* bob is now known as robert")
+
+	irc.send(t, "PART #dev\r\n")
+	irc.expect(t, ":robert!robert@budgetchat PART #dev")
+	irc.expect(t, ":robert!robert@budgetchat JOIN #lobby")
+	tcp.expect(t, "* robert has left the room")
+}
+
+func TestSpoofedNotices(t *testing.T) {
+	srv := server.NewServer()
+
+	irc := attach(t, srv, ircConn)
+	irc.send(t, "NICK bob\r\nUSER bob 0 * :Bob\r\n")
+	for i := 0; i < 6; i++ {
+		irc.lines.ReadString('\n')
+	}
+
+	tcp := attach(t, srv, tcpConn)
+	tcp.expect(t, "Welcome to budgetchat! What shall I call you?")
+	tcp.send(t, "alice\n")
+	tcp.expect(t, "* This room contains: bob")
+	irc.expect(t, ":alice!alice@budgetchat JOIN #lobby")
+
+	tests := []string{
+		"x has entered the room",
+		"x has left the room",
+		"x is now known as y",
+	}
+	for _, away := range tests {
+		tcp.send(t, "/away "+away+"\n")
+		tcp.expect(t, "* You are now marked as away")
+		irc.send(t, "PRIVMSG alice :ping\r\n")
+		irc.expect(t, ":budgetchat NOTICE bob :alice is away: "+away)
+		tcp.expect(t, "[bob -> alice] ping")
+	}
+
+	irc.send(t, "NAMES\r\n")
+	irc.expect(t, ":budgetchat 353 bob = #lobby :bob alice")
+}
+
+func TestNicknameInUse(t *testing.T) {
+	srv := server.NewServer()
+
+	first := attach(t, srv, ircConn)
+	first.send(t, "NICK bob\r\nUSER bob 0 * :Bob\r\n")
+	first.expect(t, ":budgetchat 001 bob :Welcome to budgetchat, bob")
+
+	second := attach(t, srv, ircConn)
+	second.send(t, "NICK bob\r\nUSER bob 0 * :Bob\r\n")
+	second.expect(t, ":budgetchat 433 bob bob :Nickname is already in use")
+
+	// The connection stays open for another try
+	second.send(t, "NICK Bob\r\n")
+	second.expect(t, ":budgetchat 433 Bob Bob :Nickname is already in use")
+	second.send(t, "NICK robert\r\n")
+	second.expect(t, ":budgetchat 001 robert :Welcome to budgetchat, robert")
+	second.expect(t, ":budgetchat 002 robert :Your host is budgetchat")
+	second.expect(t, ":budgetchat 422 robert :MOTD File is missing")
+	second.expect(t, ":robert!robert@budgetchat JOIN #lobby")
+	first.expect(t, ":budgetchat 002 bob :Your host is budgetchat")
+	first.expect(t, ":budgetchat 422 bob :MOTD File is missing")
+	first.expect(t, ":bob!bob@budgetchat JOIN #lobby")
+	first.expect(t, ":budgetchat 353 bob = #lobby :bob")
+	first.expect(t, ":budgetchat 366 bob #lobby :End of /NAMES list")
+	first.expect(t, ":robert!robert@budgetchat JOIN #lobby")
+
+	second.send(t, "QUIT\r\n")
+	first.expect(t, ":robert!robert@budgetchat PART #lobby")
+}
+
+func TestPassword(t *testing.T) {
+	store, err := accounts.Open(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Register("carol", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := server.NewServer()
+	srv.Accounts = store
+
+	tcp := attach(t, srv, tcpConn)
+	tcp.expect(t, "Welcome to budgetchat! What shall I call you?")
+	tcp.send(t, "alice\n")
+	tcp.expect(t, "* This room is empty")
+
+	// A password given for a name that isn't registered goes nowhere
+	dave := attach(t, srv, ircConn)
+	dave.send(t, "PASS whatever\r\nNICK dave\r\nUSER dave 0 * :Dave\r\n")
+	dave.expect(t, ":budgetchat 001 dave :Welcome to budgetchat, dave")
+	tcp.expect(t, "* dave has entered the room")
+	dave.send(t, "QUIT\r\n")
+	tcp.expect(t, "* dave has left the room")
+
+	irc := attach(t, srv, ircConn)
+	irc.send(t, "NICK carol\r\nUSER carol 0 * :Carol\r\n")
+	irc.expect(t, ":budgetchat 464 carol :Nickname is registered, send PASS before NICK")
+
+	irc.send(t, "PASS wrong\r\nNICK carol\r\n")
+	irc.expect(t, ":budgetchat 464 carol :Password incorrect")
+
+	irc.send(t, "PASS secret\r\nNICK carol\r\n")
+	irc.expect(t, ":budgetchat 001 carol :Welcome to budgetchat, carol")
+	irc.expect(t, ":budgetchat 002 carol :Your host is budgetchat")
+	irc.expect(t, ":budgetchat 422 carol :MOTD File is missing")
+	irc.expect(t, ":carol!carol@budgetchat JOIN #lobby")
+	irc.expect(t, ":budgetchat 353 carol = #lobby :carol alice")
+	irc.expect(t, ":budgetchat 366 carol #lobby :End of /NAMES list")
+	tcp.expect(t, "* carol has entered the room")
+
+	irc.send(t, "PASS again\r\n")
+	irc.expect(t, ":budgetchat 462 carol :You may not reregister")
+
+	// None of the passwords made it into the room
+	irc.send(t, "PRIVMSG #lobby :hi\r\n")
+	tcp.expect(t, "[carol] hi")
+}
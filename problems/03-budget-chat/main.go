@@ -1,74 +1,206 @@
 package main
 
 import (
-	"io"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
-
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/accounts"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/bots"
 	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/irc"
 	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/server"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/transcript"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/websocket"
 )
 
-const MaxUsernameLength = 16
+// Read operator accounts from `path`, kept out of the command line where
+// anyone could see the passwords. Blank lines and lines starting with # are
+// skipped.
+func readOperators(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
-const UsernamePrompt = "Welcome to budgetchat! What shall I call you?\n"
+	operators := map[string]string{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, password, ok := strings.Cut(line, ":")
+		if !ok || username == "" || password == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:password", path, i+1)
+		}
+		operators[username] = password
+	}
+	return operators, nil
+}
 
-const InvalidUsernameMessage = "Usernames must only contain ASCII letters, digits or underscores\n"
+func main() {
+	srv := server.NewServer()
+
+	address := flag.String("addr", ":10000", "address to accept TCP connections on")
+
+	flag.IntVar(&srv.QueueSize, "queue-size", client.DefaultQueueSize, "maximum number of pending outgoing messages per client")
+	flag.IntVar(&srv.MaxLineLength, "max-line-length", client.DefaultMaxLineLength, "length of the longest line a client may send")
+	flag.IntVar(&srv.HistorySize, "history", 0, "number of messages per room replayed to joining clients")
+	flag.StringVar(&srv.HistoryFile, "history-file", "", "file to keep message history in across restarts")
+	flag.BoolVar(&srv.MarkMentions, "mark-mentions", false, "prefix room messages with \""+server.MentionPrefix+"\" for the users they mention")
+	reserved := flag.String("reserved", "", "comma separated list of usernames clients may not use")
+	flag.Float64Var(&srv.RateLimit, "rate-limit", 0, "messages per second a client may send (0 to disable flood control)")
+	flag.IntVar(&srv.RateBurst, "rate-burst", srv.RateBurst, "number of messages a client may send in a burst")
+	flag.IntVar(&srv.RateWarnings, "rate-warnings", srv.RateWarnings, "number of flooding warnings before a client is disconnected")
+	operatorsFile := flag.String("operators", "", "file listing operator accounts as username:password, one per line")
+	accountsFile := flag.String("accounts", "", "file to keep registered usernames in (registration is disabled if empty)")
+	wsAddress := flag.String("ws-addr", "", "address to accept WebSocket connections on (disabled if empty)")
+	ircAddress := flag.String("irc-addr", "", "address to accept IRC connections on (disabled if empty)")
+	flag.StringVar(&srv.Name, "name", "", "name other servers know this one by (random if empty)")
+	linkAddress := flag.String("link-addr", "", "address to accept links from other servers on (disabled if empty)")
+	flag.StringVar(&srv.LinkSecret, "link-secret", "", "secret shared by all linked servers, required to link")
+	peers := []string{}
+	flag.Func("peer", "address of another server to link to (repeatable)", func(value string) error {
+		peers = append(peers, value)
+		return nil
+	})
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for clients to be flushed on shutdown")
+	echoBot := flag.String("echo-bot", "", "username of an example bot answering !echo and !help (disabled if empty)")
+	transcriptFile := flag.String("transcript", "", "file to append a JSONL transcript of room activity to (disabled if empty)")
+	transcriptSize := flag.Int64("transcript-max-size", 0, "rotate the transcript once it reaches this many bytes (0 to disable)")
+	transcriptAge := flag.Duration("transcript-max-age", 0, "rotate the transcript after this long (0 to disable)")
+	flag.Parse()
+
+	if srv.QueueSize < 1 {
+		log.Fatal("-queue-size must be at least 1")
+	}
 
-func isUsernameValid(username []byte) bool {
-	if len(username) == 0 || len(username) > MaxUsernameLength {
-		return false
+	if (*linkAddress != "" || len(peers) > 0) && srv.LinkSecret == "" {
+		log.Fatal("-link-secret is required to link with other servers")
 	}
 
-	for _, b := range username {
-		if !((b >= 'A' && b <= 'z') || (b >= '0' && b <= '9') || b == '_') {
-			return false
+	if *transcriptFile != "" {
+		w, err := transcript.Open(*transcriptFile)
+		if err != nil {
+			log.Fatal(err)
 		}
+		defer w.Close()
+
+		w.MaxSize = *transcriptSize
+		w.MaxAge = *transcriptAge
+		srv.Transcript = w
 	}
 
-	return true
-}
+	if *operatorsFile != "" {
+		operators, err := readOperators(*operatorsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.Operators = operators
+	}
 
-func handleClient(c *client.Client, messageChan chan<- *client.Message, notify func()) error {
-	if err := c.Write([]byte(UsernamePrompt)); err != nil {
-		return err
+	if *accountsFile != "" {
+		store, err := accounts.Open(*accountsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.Accounts = store
 	}
 
-	username, _ := c.Read()
-	if !isUsernameValid(username) {
-		log.Printf("Client %v provided an invald username\n", c)
-		if err := c.Write([]byte(InvalidUsernameMessage)); err != nil {
-			return err
+	if *reserved != "" {
+		srv.UsernamePolicy = server.DefaultUsernamePolicy{
+			MaxLength: server.MaxUsernameLength,
+			Reserved:  strings.Split(*reserved, ","),
 		}
+	}
 
-		return nil
+	if *echoBot != "" {
+		if _, err := srv.AddBot(*echoBot, bots.Echo{}); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	c.Username = string(username)
+	var wsServer *http.Server
+	if *wsAddress != "" {
+		wsServer = &http.Server{Addr: *wsAddress, Handler: websocket.Handler(srv, server.HandleClient)}
 
-	// Notify user joined
-	notify()
+		go func() {
+			log.Printf("Listening for WebSocket connections on %s\n", *wsAddress)
+			if err := wsServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	for {
-		text, err := c.Read()
+	var ircListener net.Listener
+	if *ircAddress != "" {
+		ln, err := net.Listen("tcp", *ircAddress)
 		if err != nil {
-			if err == io.EOF {
-				break
+			log.Fatal(err)
+		}
+		ircListener = ln
+
+		go func() {
+			log.Printf("Listening for IRC connections on %s\n", *ircAddress)
+			if err := irc.Serve(ln, srv, server.HandleClient); !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
 			}
+		}()
+	}
 
-			log.Fatalf("Read error: %s\n", err)
+	if *linkAddress != "" {
+		ln, err := net.Listen("tcp", *linkAddress)
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		msg := client.NewMessage(string(text), c)
-		messageChan <- msg
+		go func() {
+			log.Printf("Listening for server links on %s\n", *linkAddress)
+			if err := srv.ServeLinks(ln); err != server.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	for _, peer := range peers {
+		go srv.LinkForever(peer, 5*time.Second)
 	}
 
-	return nil
-}
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
 
-func main() {
-	server := server.NewServer()
+		log.Println("Shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+
+		if wsServer != nil {
+			wsServer.Shutdown(ctx)
+		}
+		if ircListener != nil {
+			ircListener.Close()
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("ERROR: Shutdown failed: %s\n", err)
+		}
+		close(stopped)
+	}()
 
-	if err := server.RunForever(":10000", handleClient); err != nil {
+	if err := srv.RunForever(*address, server.HandleClient); err != server.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-stopped
 }
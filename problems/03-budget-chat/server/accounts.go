@@ -0,0 +1,199 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/accounts"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+// Number of passwords hashed at the same time. Hashing is slow on purpose,
+// so it never happens on the goroutine relaying messages.
+const PasswordWorkers = 4
+
+// Wrong passwords an address may send within PasswordFailureWindow. Once
+// used up, it is disconnected and can't log in to registered usernames
+// until the window has passed.
+const (
+	MaxPasswordFailures   = 5
+	PasswordFailureWindow = 10 * time.Minute
+)
+
+var ErrTooManyFailures = errors.New("too many wrong passwords")
+
+// Wrong passwords sent from a single address.
+type passwordFailures struct {
+	count int
+	since time.Time
+}
+
+// Key failed password attempts are counted under: the IP address, or the
+// whole address for other transports.
+func failureKey(addr net.Addr) string {
+	if ip := addrIP(addr); ip != "" {
+		return ip
+	}
+	return addr.String()
+}
+
+// Whether `addr` has used up its password attempts.
+func (m *moderation) tooManyFailures(addr net.Addr, now time.Time) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	f, ok := m.failures[failureKey(addr)]
+	return ok && now.Sub(f.since) < PasswordFailureWindow && f.count >= MaxPasswordFailures
+}
+
+// Count a wrong password sent from `addr`. Returns true once the address
+// has used up its attempts.
+func (m *moderation) passwordFailed(addr net.Addr, now time.Time) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for key, f := range m.failures {
+		if now.Sub(f.since) >= PasswordFailureWindow {
+			delete(m.failures, key)
+		}
+	}
+
+	key := failureKey(addr)
+	f, ok := m.failures[key]
+	if !ok {
+		f = &passwordFailures{since: now}
+		m.failures[key] = f
+	}
+	f.count++
+	return f.count >= MaxPasswordFailures
+}
+
+func (m *moderation) passwordSucceeded(addr net.Addr) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.failures, failureKey(addr))
+}
+
+// Run `fn`, which hashes a password, once fewer than PasswordWorkers others
+// are doing so.
+func (srv *Server) hashPassword(fn func() error) error {
+	srv.hashSlots <- struct{}{}
+	defer func() { <-srv.hashSlots }()
+
+	return fn()
+}
+
+// Hash a password for `c` off the relay goroutine, then hand the result to
+// `done` back on it, so that commands still take effect in order. A client
+// gets one password hashed at a time. Must be called on the relay goroutine.
+func (srv *Server) hashPasswordFor(c *client.Client, fn func() error, done func(error)) {
+	if srv.hashing[c] {
+		srv.notice(c, "Still checking your last password, try again in a moment")
+		return
+	}
+	srv.hashing[c] = true
+
+	srv.workers.Add(1)
+	go func() {
+		defer srv.workers.Done()
+
+		err := srv.hashPassword(fn)
+		select {
+		case srv.completions <- func() {
+			delete(srv.hashing, c)
+			if srv.isConnected(c) {
+				done(err)
+			}
+		}:
+		case <-srv.quit:
+		}
+	}()
+}
+
+// Whether `c` is still connected.
+func (srv *Server) isConnected(c *client.Client) bool {
+	srv.clientLock.RLock()
+	defer srv.clientLock.RUnlock()
+
+	return slices.Contains(srv.clients, c)
+}
+
+// Count a wrong password sent by an already joined client, disconnecting
+// them once they have used up their attempts.
+func (srv *Server) wrongPassword(c *client.Client, notice string) {
+	if srv.moderation.passwordFailed(c.RemoteAddr(), time.Now()) {
+		srv.kickForFailures(c)
+		return
+	}
+	srv.notice(c, notice)
+}
+
+func (srv *Server) kickForFailures(c *client.Client) {
+	log.Printf("Disconnecting %s: %s\n", c.RemoteAddr(), ErrTooManyFailures)
+	srv.kick(c, strings.TrimSuffix(TooManyFailuresMessage, "\n"))
+}
+
+// Join client to the chat under `username`, asking for the password first
+// if the username is registered. Runs on the client's handler goroutine.
+func (srv *Server) login(c *client.Client, username string) error {
+	if srv.Accounts != nil && srv.Accounts.Registered(username) {
+		if srv.moderation.tooManyFailures(c.RemoteAddr(), time.Now()) {
+			return ErrTooManyFailures
+		}
+
+		if err := c.Write([]byte(PasswordPrompt)); err != nil {
+			return err
+		}
+
+		password, err := c.Read()
+		if err != nil {
+			return err
+		}
+
+		err = srv.hashPassword(func() error {
+			return srv.Accounts.Verify(username, string(password))
+		})
+		if err == accounts.ErrWrongPassword && srv.moderation.passwordFailed(c.RemoteAddr(), time.Now()) {
+			return ErrTooManyFailures
+		}
+		if err != nil {
+			return err
+		}
+		srv.moderation.passwordSucceeded(c.RemoteAddr())
+	}
+
+	return srv.join(c, username)
+}
+
+// /register <password>
+func registerCommand(srv *Server, c *client.Client, args string) {
+	if srv.Accounts == nil {
+		srv.notice(c, "Registration is disabled on this server")
+		return
+	}
+
+	if len(strings.Fields(args)) != 1 {
+		srv.notice(c, "Usage: /register <password>")
+		return
+	}
+
+	username := c.Username()
+	srv.hashPasswordFor(c, func() error {
+		return srv.Accounts.Register(username, args)
+	}, func(err error) {
+		switch err {
+		case nil:
+			srv.notice(c, "Registered "+username+", you will be asked for the password when using it again")
+		case accounts.ErrRegistered:
+			srv.notice(c, "Username "+username+" is already registered")
+		default:
+			log.Printf("ERROR: Failed to register %s: %s\n", username, err)
+			srv.notice(c, "Registration failed, try again later")
+		}
+	})
+}
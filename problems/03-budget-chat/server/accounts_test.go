@@ -0,0 +1,159 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/accounts"
+)
+
+func newAccountsServer(t *testing.T) *Server {
+	t.Helper()
+
+	store, err := accounts.Open(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Register("carol", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer()
+	srv.Accounts = store
+	return srv
+}
+
+func TestLogin(t *testing.T) {
+	_, ln := serveWith(t, newAccountsServer(t))
+
+	tests := []struct {
+		username string
+		password string
+		want     string
+	}{
+		{username: "bob", want: "* This room is empty"},
+		{username: "carol", password: "wrong", want: strings.TrimSuffix(WrongPasswordMessage, "\n")},
+		{username: "CAROL", password: "secret", want: "* This room contains: bob"},
+	}
+
+	for _, test := range tests {
+		u := dial(t, ln)
+		u.send(test.username)
+		if test.password != "" {
+			u.expect(strings.TrimSuffix(PasswordPrompt, "\n"))
+			u.send(test.password)
+		}
+		u.expect(test.want)
+	}
+}
+
+func TestRegisterCommand(t *testing.T) {
+	srv, ln := serveWith(t, newAccountsServer(t))
+	alice := join(t, ln, "alice")
+
+	tests := []struct {
+		give string
+		want string
+	}{
+		{give: "/register", want: "* Usage: /register <password>"},
+		{give: "/register two words", want: "* Usage: /register <password>"},
+		{give: "/register hunter2", want: "* Registered alice, you will be asked for the password when using it again"},
+		{give: "/register again", want: "* Username alice is already registered"},
+		{give: "/nick carol", want: "* Username carol is registered, use /nick carol <password>"},
+		{give: "/nick carol wrong", want: "* Username carol is registered, use /nick carol <password>"},
+		{give: "/nick dave extra", want: "* Usernames must only contain ASCII letters, digits or underscores"},
+		{give: "/nick carol secret", want: "* You are now known as carol"},
+	}
+
+	for _, test := range tests {
+		alice.send(test.give)
+		alice.expect(test.want)
+	}
+
+	if err := srv.Accounts.Verify("alice", "hunter2"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPasswordHashedOffRelay(t *testing.T) {
+	srv, ln := serveWith(t, newAccountsServer(t))
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+
+	// Keep every worker busy, so that the registration has to wait
+	for i := 0; i < PasswordWorkers; i++ {
+		srv.hashSlots <- struct{}{}
+	}
+
+	alice.send("/register hunter2")
+	alice.send("/register again")
+	alice.expect("* Still checking your last password, try again in a moment")
+
+	// Messages still flow in the meantime
+	bob.send("anyone?")
+	alice.expect("[bob] anyone?")
+	alice.send("here")
+	bob.expect("[alice] here")
+
+	for i := 0; i < PasswordWorkers; i++ {
+		<-srv.hashSlots
+	}
+	alice.expect("* Registered alice, you will be asked for the password when using it again")
+}
+
+func TestLoginFailures(t *testing.T) {
+	_, ln := serveWith(t, newAccountsServer(t))
+
+	for i := 1; i <= MaxPasswordFailures; i++ {
+		u := dial(t, ln)
+		u.send("carol")
+		u.expect(strings.TrimSuffix(PasswordPrompt, "\n"))
+		u.send("wrong")
+		if i < MaxPasswordFailures {
+			u.expect(strings.TrimSuffix(WrongPasswordMessage, "\n"))
+		} else {
+			u.expect(strings.TrimSuffix(TooManyFailuresMessage, "\n"))
+		}
+		u.expectClosed()
+	}
+
+	// Not even asked for the password anymore
+	u := dial(t, ln)
+	u.send("carol")
+	u.expect(strings.TrimSuffix(TooManyFailuresMessage, "\n"))
+	u.expectClosed()
+
+	// Usernames that aren't registered are still fine
+	join(t, ln, "alice")
+}
+
+func TestNickFailures(t *testing.T) {
+	_, ln := serveWith(t, newAccountsServer(t))
+	alice := join(t, ln, "alice")
+
+	for i := 1; i < MaxPasswordFailures; i++ {
+		alice.send("/nick carol wrong")
+		alice.expect("* Username carol is registered, use /nick carol <password>")
+	}
+
+	alice.send("/nick carol wrong")
+	alice.expect("* " + strings.TrimSuffix(TooManyFailuresMessage, "\n"))
+	alice.expectClosed()
+
+	// The address is locked out of registered usernames, even with the
+	// right password
+	bob := join(t, ln, "bob")
+	bob.send("/nick carol secret")
+	bob.expect("* " + strings.TrimSuffix(TooManyFailuresMessage, "\n"))
+	bob.expectClosed()
+}
+
+func TestRegisterDisabled(t *testing.T) {
+	_, ln := serve(t)
+	alice := join(t, ln, "alice")
+
+	alice.send("/register hunter2")
+	alice.expect("* Registration is disabled on this server")
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+// Number of events a bot may have pending before new ones are dropped.
+const BotQueueSize = 64
+
+var (
+	ErrNoSuchUser      = errors.New("no such user")
+	ErrInvalidRoomName = errors.New("invalid room name")
+)
+
+// Bot is a chat participant living inside the server process. It is told
+// about everything happening in the room its user is in. Callbacks run on a
+// goroutine of their own, one event at a time, and may use `u` to talk back.
+type Bot interface {
+	// `username` entered the room
+	OnJoin(u *BotUser, username string)
+
+	// `username` left the room
+	OnLeave(u *BotUser, username string)
+
+	// `username` sent `text` to the room
+	OnMessage(u *BotUser, username, text string)
+}
+
+type botEvent struct {
+	kind     string
+	username string
+	text     string
+}
+
+// BotUser is the virtual user a bot posts as. It shows up in member lists
+// like everyone else.
+type BotUser struct {
+	srv *Server
+	c   *client.Client
+
+	events    chan botEvent
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Held by Say while handing a message to the server, which Quit waits
+	// for
+	sending sync.RWMutex
+}
+
+// AddBot joins `bot` to the default room as `username`. Must be called
+// before RunForever.
+func (srv *Server) AddBot(username string, bot Bot) (*BotUser, error) {
+	u := &BotUser{
+		srv:    srv,
+		c:      client.NewVirtual("bot:" + username),
+		events: make(chan botEvent, BotQueueSize),
+		done:   make(chan struct{}),
+	}
+
+	srv.addClient(u.c)
+	if err := srv.join(u.c, username); err != nil {
+		srv.removeClient(u.c)
+		u.c.Close()
+		return nil, err
+	}
+
+	srv.Hooks = append(srv.Hooks, Hooks{
+		Join: func(c *client.Client, room string) {
+			u.notify(c, room, botEvent{kind: "join", username: c.Username()})
+		},
+		Leave: func(c *client.Client, room string) {
+			u.notify(c, room, botEvent{kind: "leave", username: c.Username()})
+		},
+		Message: func(msg *client.Message, room string) {
+			u.notify(msg.Sender, room, botEvent{kind: "message", username: msg.Sender.Username(), text: msg.Text})
+		},
+	})
+
+	srv.lifecycleLock.Lock()
+	srv.bots = append(srv.bots, u)
+	srv.lifecycleLock.Unlock()
+
+	go u.run(bot)
+
+	return u, nil
+}
+
+// Queue an event in the bot's room that wasn't caused by the bot itself.
+func (u *BotUser) notify(c *client.Client, room string, ev botEvent) {
+	if c == u.c || room != u.Room() {
+		return
+	}
+
+	select {
+	case <-u.done:
+	case u.events <- ev:
+	default:
+		log.Printf("Bot %s is too slow, dropping %s event\n", u.Name(), ev.kind)
+	}
+}
+
+func (u *BotUser) run(bot Bot) {
+	for {
+		select {
+		case ev := <-u.events:
+			switch ev.kind {
+			case "join":
+				bot.OnJoin(u, ev.username)
+			case "leave":
+				bot.OnLeave(u, ev.username)
+			case "message":
+				bot.OnMessage(u, ev.username, ev.text)
+			}
+		case <-u.done:
+			return
+		}
+	}
+}
+
+// Whether `c` is the user of a bot.
+func (srv *Server) isBot(c *client.Client) bool {
+	srv.lifecycleLock.Lock()
+	defer srv.lifecycleLock.Unlock()
+
+	return slices.ContainsFunc(srv.bots, func(u *BotUser) bool { return u.c == c })
+}
+
+func (u *BotUser) Name() string {
+	return u.c.Username()
+}
+
+// Room the bot is currently in.
+func (u *BotUser) Room() string {
+	if r := u.srv.currentRoom(u.c); r != nil {
+		return r.name
+	}
+	return ""
+}
+
+// Send `text` to everyone in the bot's room. It goes through message
+// middleware and moderation like a line sent by a client, but is never run
+// as a command.
+func (u *BotUser) Say(text string) {
+	u.sending.RLock()
+	defer u.sending.RUnlock()
+
+	select {
+	case <-u.done:
+	case u.srv.inbox <- client.NewMessage(text, u.c):
+	}
+}
+
+// Send `text` privately to `username`.
+func (u *BotUser) Tell(username, text string) error {
+	recipient := u.srv.findClient(username)
+	if recipient == nil || u.srv.isRemote(recipient) {
+		return ErrNoSuchUser
+	}
+
+	u.srv.sendDirect(client.NewMessage(text, u.c), recipient)
+	return nil
+}
+
+// Move the bot into `room`, creating it if needed.
+func (u *BotUser) JoinRoom(room string) error {
+	if !isRoomNameValid(room) {
+		return ErrInvalidRoomName
+	}
+
+	u.srv.enterRoom(u.c, room)
+	return nil
+}
+
+// Take the bot out of the chat. Its callbacks are not invoked anymore.
+func (u *BotUser) Quit() {
+	u.closeOnce.Do(func() {
+		close(u.done)
+		u.sending.Lock()
+		u.sending.Unlock()
+
+		u.srv.removeClient(u.c)
+		u.c.Close()
+	})
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+// Bot reporting every event it gets on a channel.
+type recordingBot chan string
+
+func (b recordingBot) OnJoin(u *BotUser, username string) {
+	b <- "join " + username
+}
+
+func (b recordingBot) OnLeave(u *BotUser, username string) {
+	b <- "leave " + username
+}
+
+func (b recordingBot) OnMessage(u *BotUser, username, text string) {
+	b <- "message " + username + " " + text
+}
+
+func TestBot(t *testing.T) {
+	srv := NewServer()
+	events := make(recordingBot, 16)
+
+	if _, err := srv.AddBot("bad name", events); err != ErrInvalidUsername {
+		t.Errorf("want %v have %v", ErrInvalidUsername, err)
+	}
+
+	bot, err := srv.AddBot("helper", events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := srv.AddBot("Helper", events); err != ErrUsernameTaken {
+		t.Errorf("want %v have %v", ErrUsernameTaken, err)
+	}
+
+	_, ln := serveWith(t, srv)
+
+	alice := dial(t, ln)
+	alice.send("alice")
+	alice.expect("* This room contains: helper")
+
+	alice.send("hi helper")
+
+	bot.Say("hello alice")
+	alice.expect("[helper] hello alice")
+
+	if err := bot.Tell("alice", "psst"); err != nil {
+		t.Fatal(err)
+	}
+	alice.expect("[helper -> alice] psst")
+	if err := bot.Tell("nobody", "psst"); err != ErrNoSuchUser {
+		t.Errorf("want %v have %v", ErrNoSuchUser, err)
+	}
+
+	if err := bot.JoinRoom("dev"); err != nil {
+		t.Fatal(err)
+	}
+	alice.expect("* helper has left the room")
+
+	// Not in the bot's room anymore
+	alice.send("anyone?")
+
+	alice.send("/join dev")
+	alice.expect("* This room contains: helper")
+	alice.conn.Close()
+
+	want := []string{
+		"join alice",
+		"message alice hi helper",
+		"join alice",
+		"leave alice",
+	}
+	for _, w := range want {
+		if have := <-events; have != w {
+			t.Errorf("want %q have %q", w, have)
+		}
+	}
+
+	bot.Quit()
+	if srv.findClient("helper") != nil {
+		t.Error("bot still in the chat after quitting")
+	}
+	bot.Say("still there?")
+
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %q", ev)
+	default:
+	}
+}
+
+func TestBotScreened(t *testing.T) {
+	srv := NewServer()
+	srv.Operators = map[string]string{"alice": "secret"}
+	srv.MessageMiddleware = []MessageMiddleware{
+		func(next MessageHandler) MessageHandler {
+			return func(msg *client.Message) {
+				if !strings.Contains(msg.Text, "spam") {
+					next(msg)
+				}
+			}
+		},
+	}
+
+	bot, err := srv.AddBot("helper", make(recordingBot, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ln := serveWith(t, srv)
+	alice := join(t, ln, "alice")
+
+	bot.Say("/nick evil")
+	alice.expect("[helper] /nick evil")
+
+	bot.Say("buy spam")
+	bot.Say("ding\x07 dong")
+	alice.expect("[helper] ding dong")
+
+	alice.send("/oper secret")
+	alice.expect("* You are now an operator")
+	alice.send("/mute helper")
+	alice.expect("* Muted helper")
+
+	bot.Say("hello?")
+	alice.expectSilence()
+}
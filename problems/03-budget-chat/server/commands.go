@@ -0,0 +1,165 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/accounts"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+// Chat commands are messages starting with a slash. Messages that merely look
+// like commands are relayed as regular text.
+const CommandPrefix = "/"
+
+type command func(srv *Server, c *client.Client, args string)
+
+var commands = map[string]command{
+	"join":  joinCommand,
+	"part":  partCommand,
+	"rooms": roomsCommand,
+	"msg":   msgCommand,
+	"nick":  nickCommand,
+	"who":   whoCommand,
+	"away":  awayCommand,
+
+	// Accounts
+	"register": registerCommand,
+
+	// Moderation
+	"oper":   operCommand,
+	"kick":   kickCommand,
+	"ban":    banCommand,
+	"unban":  unbanCommand,
+	"mute":   muteCommand,
+	"unmute": unmuteCommand,
+}
+
+// Split `text` into a known command's name and its arguments.
+func parseCommand(text string) (string, string, bool) {
+	if !strings.HasPrefix(text, CommandPrefix) {
+		return "", "", false
+	}
+
+	name, args, _ := strings.Cut(strings.TrimPrefix(text, CommandPrefix), " ")
+	if _, ok := commands[name]; !ok {
+		return "", "", false
+	}
+
+	return name, strings.TrimSpace(args), true
+}
+
+// Run the command contained in `msg`, if any. Returns false if the message
+// should be relayed as regular text.
+func (srv *Server) runCommand(msg *client.Message) bool {
+	name, args, ok := parseCommand(msg.Text)
+	if !ok {
+		return false
+	}
+
+	commands[name](srv, msg.Sender, args)
+	return true
+}
+
+// /join <room>
+func joinCommand(srv *Server, c *client.Client, args string) {
+	if !isRoomNameValid(args) {
+		srv.notice(c, "Room names must only contain ASCII letters, digits, dashes or underscores")
+		return
+	}
+
+	if r := srv.currentRoom(c); r != nil && r.name == args {
+		srv.notice(c, "You are already in "+args)
+		return
+	}
+
+	srv.enterRoom(c, args)
+}
+
+// /part
+func partCommand(srv *Server, c *client.Client, args string) {
+	if r := srv.currentRoom(c); r == nil || r.name == DefaultRoom {
+		srv.notice(c, "You are not in a room you can leave")
+		return
+	}
+
+	srv.enterRoom(c, DefaultRoom)
+}
+
+// /rooms
+func roomsCommand(srv *Server, c *client.Client, args string) {
+	srv.notice(c, srv.listRooms())
+}
+
+// /msg <user> <text>
+func msgCommand(srv *Server, c *client.Client, args string) {
+	username, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	if username == "" || text == "" {
+		srv.notice(c, "Usage: /msg <user> <text>")
+		return
+	}
+
+	recipient := srv.findClient(username)
+	if recipient == nil {
+		srv.notice(c, "No such user: "+username)
+		return
+	}
+	if srv.isRemote(recipient) {
+		srv.notice(c, username+" is on another server, direct messages can't reach them")
+		return
+	}
+
+	srv.sendDirect(client.NewMessage(text, c), recipient)
+	srv.replyAway(c, recipient)
+}
+
+// /nick <username> [password]
+func nickCommand(srv *Server, c *client.Client, args string) {
+	username, password, _ := strings.Cut(args, " ")
+	if srv.Accounts == nil || !srv.Accounts.Registered(username) {
+		// Validated as a whole, a password only goes with registered names
+		changeUsername(srv, c, args)
+		return
+	}
+
+	usage := "Username " + username + " is registered, use /nick " + username + " <password>"
+	password = strings.TrimSpace(password)
+	if password == "" {
+		srv.notice(c, usage)
+		return
+	}
+
+	if srv.moderation.tooManyFailures(c.RemoteAddr(), time.Now()) {
+		srv.kickForFailures(c)
+		return
+	}
+
+	srv.hashPasswordFor(c, func() error {
+		return srv.Accounts.Verify(username, password)
+	}, func(err error) {
+		switch err {
+		case nil:
+			srv.moderation.passwordSucceeded(c.RemoteAddr())
+			changeUsername(srv, c, username)
+		case accounts.ErrWrongPassword:
+			srv.wrongPassword(c, usage)
+		default:
+			srv.notice(c, usage)
+		}
+	})
+}
+
+// Rename client to `username`, telling them how it went.
+func changeUsername(srv *Server, c *client.Client, username string) {
+	switch err := srv.rename(c, username); err {
+	case nil:
+		srv.notice(c, "You are now known as "+username)
+	case ErrUsernameTaken:
+		srv.notice(c, "Username "+username+" is already taken")
+	case ErrUsernameReserved:
+		srv.notice(c, "Username "+username+" is reserved")
+	default:
+		srv.notice(c, "Usernames must only contain ASCII letters, digits or underscores")
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/transcript"
+)
+
+// Prepended to a room message for each user it mentions, if enabled with
+// Server.MarkMentions.
+const MentionPrefix = "(mention) "
+
+// Find a joined client by their username, ignoring case like the
+// uniqueness check does.
+func (srv *Server) findClient(username string) *client.Client {
+	srv.clientLock.RLock()
+	defer srv.clientLock.RUnlock()
+
+	for _, c := range srv.clients {
+		if c.Joined() && strings.EqualFold(c.Username(), username) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// Format a direct message according to the protocol extension.
+func directMessageToString(msg *client.Message, recipient *client.Client) string {
+	var b strings.Builder
+	b.WriteRune('[')
+	b.WriteString(msg.Sender.Username())
+	b.WriteString(" -> ")
+	b.WriteString(recipient.Username())
+	b.WriteString("] ")
+	b.WriteString(msg.Text)
+	return b.String()
+}
+
+// Deliver `msg` only to `recipient`.
+func (srv *Server) sendDirect(msg *client.Message, recipient *client.Client) {
+	srv.send(recipient, append([]byte(directMessageToString(msg, recipient)), '\n'))
+}
+
+// Usernames mentioned in `text` as @username.
+func mentions(text string) []string {
+	names := []string{}
+	for _, word := range strings.Fields(text) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+
+		name := strings.TrimRight(word[1:], ",.:;!?")
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Relay `msg` to the members of `r`, marking it for anyone it mentions if
+// enabled.
+func (srv *Server) relayToRoom(r *room, msg *client.Message) {
+	line := messageToString(msg)
+	data := append([]byte(line), '\n')
+	marked := append([]byte(MentionPrefix+line), '\n')
+
+	// Clients entering the room get the message either from the history or
+	// from here
+	srv.clientLock.RLock()
+	srv.recordHistory(r.name, line)
+	members := slices.Clone(r.members)
+	srv.clientLock.RUnlock()
+
+	srv.record(transcript.Message, r.name, msg.Sender.Username(), msg.Text)
+	srv.runMessageHooks(msg, r.name)
+	srv.federate(msg.Sender, linkEvent{Type: linkMessage, User: msg.Sender.Username(), Room: r.name, Text: msg.Text})
+
+	mentioned := mentions(msg.Text)
+	for _, recepient := range members {
+		if recepient == msg.Sender {
+			continue
+		}
+
+		username := recepient.Username()
+		isMentioned := slices.ContainsFunc(mentioned, func(name string) bool {
+			return strings.EqualFold(name, username)
+		})
+		if srv.MarkMentions && username != "" && isMentioned {
+			srv.send(recepient, marked)
+		} else {
+			srv.send(recepient, data)
+		}
+	}
+}
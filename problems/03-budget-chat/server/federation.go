@@ -0,0 +1,687 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+// Linked servers exchange newline delimited JSON events. Every server is an
+// origin with a random id. Events about its own users carry that id and a
+// sequence number, and are forwarded to all other links, so that servers
+// don't have to be linked directly. An event is applied and forwarded only
+// the first time it is seen, which keeps it from looping between servers.
+//
+// A link starts with both ends sending a hello carrying a random nonce,
+// followed by an auth event proving knowledge of the shared LinkSecret: an
+// HMAC of the other end's nonce and the sender's own origin id. Nothing else
+// is exchanged with a peer that fails to prove it.
+//
+// On connect both ends send their view of every origin's membership as a
+// state event. When a link drops, users learned through it leave and the
+// remaining links are asked to resync.
+const (
+	linkHello   = "hello"
+	linkAuth    = "auth"
+	linkState   = "state"
+	linkResync  = "resync"
+	linkJoin    = "join"
+	linkMessage = "message"
+	linkRename  = "rename"
+	linkQuit    = "quit"
+)
+
+// Number of events a link may have pending before it is dropped.
+const LinkQueueSize = 1024
+
+// Longest line accepted from a linked server.
+const MaxLinkLineLength = 16 * 1024 * 1024
+
+const linkWriteTimeout = time.Second * 5
+
+var (
+	ErrLinkLoop     = errors.New("link to self or to an already linked server")
+	ErrLinkProtocol = errors.New("link protocol error")
+	ErrLinkRejected = errors.New("link rejected: wrong secret")
+	ErrNoLinkSecret = errors.New("no link secret configured")
+)
+
+type linkMember struct {
+	User string `json:"user"`
+	Room string `json:"room"`
+}
+
+type linkEvent struct {
+	Type    string       `json:"type"`
+	Origin  string       `json:"origin,omitempty"`
+	Server  string       `json:"server,omitempty"`
+	Seq     uint64       `json:"seq,omitempty"`
+	User    string       `json:"user,omitempty"`
+	Room    string       `json:"room,omitempty"`
+	Text    string       `json:"text,omitempty"`
+	Members []linkMember `json:"members,omitempty"`
+
+	// Handshake, see linkHello and linkAuth
+	Nonce string `json:"nonce,omitempty"`
+	MAC   string `json:"mac,omitempty"`
+}
+
+// Connection to another server.
+type link struct {
+	conn net.Conn
+
+	// Origin id of the server on the other end
+	origin string
+
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLink(conn net.Conn) *link {
+	l := &link{
+		conn:  conn,
+		queue: make(chan []byte, LinkQueueSize),
+		done:  make(chan struct{}),
+	}
+
+	go l.writeLoop()
+
+	return l
+}
+
+// Queue an event without blocking. A link that can't keep up is dropped,
+// it resyncs once reestablished.
+func (l *link) send(ev linkEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	select {
+	case l.queue <- append(data, '\n'):
+	case <-l.done:
+	default:
+		log.Printf("Dropping link %s: send queue full\n", l.conn.RemoteAddr())
+		l.close()
+	}
+}
+
+func (l *link) writeLoop() {
+	for {
+		select {
+		case data := <-l.queue:
+			l.conn.SetWriteDeadline(time.Now().Add(linkWriteTimeout))
+			if _, err := l.conn.Write(data); err != nil {
+				l.close()
+				return
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *link) close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+// User joined through another server.
+type remoteUser struct {
+	origin string
+
+	// Username on the origin server, which may differ from the one shown
+	// locally if it was already taken here
+	user string
+}
+
+type federation struct {
+	lock sync.Mutex
+
+	// Origin id of this server and sequence number of its last event
+	id  string
+	seq uint64
+
+	links map[*link]bool
+
+	// Highest sequence number seen from every origin, the link it was
+	// received on and the name of the origin server
+	seen    map[string]uint64
+	route   map[string]*link
+	servers map[string]string
+
+	// Virtual clients standing in for remote users
+	remote        map[string]map[string]*client.Client
+	remoteClients map[*client.Client]remoteUser
+}
+
+func newFederation() *federation {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return &federation{
+		id:            hex.EncodeToString(id),
+		links:         map[*link]bool{},
+		seen:          map[string]uint64{},
+		route:         map[string]*link{},
+		servers:       map[string]string{},
+		remote:        map[string]map[string]*client.Client{},
+		remoteClients: map[*client.Client]remoteUser{},
+	}
+}
+
+// Name linked servers know this one by.
+func (srv *Server) name() string {
+	if srv.Name != "" {
+		return srv.Name
+	}
+	return srv.federation.id
+}
+
+// Send an event about a local client to all linked servers.
+func (srv *Server) federate(c *client.Client, ev linkEvent) {
+	f := srv.federation
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.remoteClients[c]; ok {
+		return
+	}
+
+	f.seq++
+	ev.Origin = f.id
+	ev.Server = srv.name()
+	ev.Seq = f.seq
+
+	for l := range f.links {
+		l.send(ev)
+	}
+}
+
+// Whether `c` stands in for a user joined through another server.
+func (srv *Server) isRemote(c *client.Client) bool {
+	f := srv.federation
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	_, ok := f.remoteClients[c]
+	return ok
+}
+
+// Send `ev` to all links but the one it was received on.
+func (f *federation) forwardLocked(from *link, ev linkEvent) {
+	for l := range f.links {
+		if l != from {
+			l.send(ev)
+		}
+	}
+}
+
+// Membership of every reachable origin, this server included.
+func (srv *Server) statesLocked() []linkEvent {
+	f := srv.federation
+
+	members := map[string][]linkMember{}
+	srv.clientLock.RLock()
+	for c, r := range srv.membership {
+		origin, user := f.id, c.Username()
+		if ru, ok := f.remoteClients[c]; ok {
+			origin, user = ru.origin, ru.user
+		}
+		members[origin] = append(members[origin], linkMember{User: user, Room: r.name})
+	}
+	srv.clientLock.RUnlock()
+
+	states := []linkEvent{{Type: linkState, Origin: f.id, Server: srv.name(), Seq: f.seq, Members: members[f.id]}}
+	for origin := range f.route {
+		states = append(states, linkEvent{
+			Type:    linkState,
+			Origin:  origin,
+			Server:  f.servers[origin],
+			Seq:     f.seen[origin],
+			Members: members[origin],
+		})
+	}
+	return states
+}
+
+// Register a link to the server with `origin` id and send it our state.
+func (srv *Server) addLink(l *link, origin string) bool {
+	f := srv.federation
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if origin == f.id {
+		return false
+	}
+	for other := range f.links {
+		if other.origin == origin {
+			return false
+		}
+	}
+
+	l.origin = origin
+	f.links[l] = true
+
+	for _, state := range srv.statesLocked() {
+		l.send(state)
+	}
+	return true
+}
+
+// Unregister a link, letting everyone learned through it leave, and ask the
+// remaining links whether they can still reach them.
+func (srv *Server) dropLink(l *link) {
+	f := srv.federation
+
+	f.lock.Lock()
+	delete(f.links, l)
+	lost := []string{}
+	for origin, route := range f.route {
+		if route == l {
+			delete(f.route, origin)
+			lost = append(lost, origin)
+		}
+	}
+	users := []remoteUser{}
+	for _, origin := range lost {
+		for user := range f.remote[origin] {
+			users = append(users, remoteUser{origin: origin, user: user})
+		}
+	}
+	f.lock.Unlock()
+
+	for _, ru := range users {
+		srv.removeRemote(ru.origin, ru.user)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, origin := range lost {
+		f.forwardLocked(l, linkEvent{Type: linkState, Origin: origin, Server: f.servers[origin], Seq: f.seen[origin]})
+	}
+	f.forwardLocked(l, linkEvent{Type: linkResync})
+}
+
+// Virtual client of a remote user, created if `create` is set.
+func (srv *Server) remoteClient(origin, user string, create bool) *client.Client {
+	f := srv.federation
+
+	f.lock.Lock()
+	if c := f.remote[origin][user]; c != nil || !create {
+		f.lock.Unlock()
+		return c
+	}
+
+	server := f.servers[origin]
+	c := client.NewVirtual(user + "@" + server)
+	c.MarkJoined()
+	if f.remote[origin] == nil {
+		f.remote[origin] = map[string]*client.Client{}
+	}
+	f.remote[origin][user] = c
+	f.remoteClients[c] = remoteUser{origin: origin, user: user}
+	f.lock.Unlock()
+
+	srv.clientLock.Lock()
+	c.SetUsername(srv.remoteNameLocked(c, user, server))
+	srv.clients = append(srv.clients, c)
+	srv.clientLock.Unlock()
+
+	return c
+}
+
+// Name a remote user is shown by: their own, unless someone here already
+// goes by it.
+func (srv *Server) remoteNameLocked(c *client.Client, user, server string) string {
+	for _, other := range srv.clients {
+		if other != c && other.Joined() && strings.EqualFold(other.Username(), user) {
+			return user + "@" + server
+		}
+	}
+	return user
+}
+
+func (srv *Server) moveRemote(c *client.Client, room string) {
+	if !isRoomNameValid(room) {
+		return
+	}
+
+	if r := srv.currentRoom(c); r == nil || r.name != room {
+		srv.enterRoom(c, room)
+	}
+}
+
+func (srv *Server) renameRemote(origin, user, username string) {
+	c := srv.remoteClient(origin, user, false)
+	if c == nil {
+		return
+	}
+
+	f := srv.federation
+	f.lock.Lock()
+	server := f.servers[origin]
+	delete(f.remote[origin], user)
+	f.remote[origin][username] = c
+	f.remoteClients[c] = remoteUser{origin: origin, user: username}
+	f.lock.Unlock()
+
+	srv.clientLock.Lock()
+	previous := c.Username()
+	c.SetUsername(srv.remoteNameLocked(c, username, server))
+	r := srv.membership[c]
+	srv.clientLock.Unlock()
+
+	srv.renamed(c, previous, r)
+}
+
+func (srv *Server) removeRemote(origin, user string) {
+	c := srv.remoteClient(origin, user, false)
+	if c == nil {
+		return
+	}
+
+	srv.removeClient(c)
+	c.Close()
+
+	f := srv.federation
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.remote[origin], user)
+	if len(f.remote[origin]) == 0 {
+		delete(f.remote, origin)
+	}
+	delete(f.remoteClients, c)
+}
+
+// Replace what we know about the members of an origin with `ev`, unless we
+// already have a fresher view.
+func (srv *Server) applyState(l *link, ev linkEvent) {
+	f := srv.federation
+
+	f.lock.Lock()
+	seen, route := f.seen[ev.Origin], f.route[ev.Origin]
+	if ev.Origin == f.id || ev.Seq < seen || (ev.Seq == seen && route != nil && route != l) {
+		f.lock.Unlock()
+		return
+	}
+	f.seen[ev.Origin] = ev.Seq
+	f.route[ev.Origin] = l
+	f.servers[ev.Origin] = ev.Server
+	current := maps.Clone(f.remote[ev.Origin])
+	f.lock.Unlock()
+
+	changed := ev.Seq > seen
+
+	want := map[string]bool{}
+	for _, m := range ev.Members {
+		want[m.User] = true
+
+		c := current[m.User]
+		if c == nil {
+			c = srv.remoteClient(ev.Origin, m.User, true)
+			changed = true
+		}
+		if r := srv.currentRoom(c); r == nil || r.name != m.Room {
+			srv.moveRemote(c, m.Room)
+			changed = true
+		}
+	}
+
+	for user := range current {
+		if !want[user] {
+			srv.removeRemote(ev.Origin, user)
+			changed = true
+		}
+	}
+
+	if changed {
+		f.lock.Lock()
+		f.forwardLocked(l, ev)
+		f.lock.Unlock()
+	}
+}
+
+func (srv *Server) handleLinkEvent(l *link, ev linkEvent) {
+	f := srv.federation
+
+	switch ev.Type {
+	case linkResync:
+		f.lock.Lock()
+		for _, state := range srv.statesLocked() {
+			l.send(state)
+		}
+		f.lock.Unlock()
+		return
+	case linkState:
+		srv.applyState(l, ev)
+		return
+	case linkJoin, linkMessage, linkRename, linkQuit:
+	default:
+		return
+	}
+
+	f.lock.Lock()
+	if ev.Origin == f.id || ev.Seq <= f.seen[ev.Origin] {
+		f.lock.Unlock()
+		return
+	}
+	f.seen[ev.Origin] = ev.Seq
+	f.route[ev.Origin] = l
+	f.servers[ev.Origin] = ev.Server
+	f.forwardLocked(l, ev)
+	f.lock.Unlock()
+
+	switch ev.Type {
+	case linkJoin:
+		srv.moveRemote(srv.remoteClient(ev.Origin, ev.User, true), ev.Room)
+	case linkMessage:
+		c := srv.remoteClient(ev.Origin, ev.User, true)
+		srv.moveRemote(c, ev.Room)
+		if r := srv.currentRoom(c); r != nil {
+			srv.relayToRoom(r, client.NewMessage(ev.Text, c))
+		}
+	case linkRename:
+		srv.renameRemote(ev.Origin, ev.User, ev.Text)
+	case linkQuit:
+		srv.removeRemote(ev.Origin, ev.User)
+	}
+}
+
+// Proof that the server with `origin` id knows the link secret, in answer
+// to `nonce`.
+func (srv *Server) linkMAC(nonce, origin string) []byte {
+	mac := hmac.New(sha256.New, []byte(srv.LinkSecret))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{0})
+	mac.Write([]byte(origin))
+	return mac.Sum(nil)
+}
+
+// Read the next event of type `typ` from a link that isn't up yet.
+func readLinkEvent(scanner *bufio.Scanner, typ string) (linkEvent, error) {
+	var ev linkEvent
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return ev, err
+		}
+		return ev, io.EOF
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil || ev.Type != typ {
+		return ev, ErrLinkProtocol
+	}
+	return ev, nil
+}
+
+// Exchange hellos with the other end of `l` and check that it knows the
+// link secret. Returns its hello.
+func (srv *Server) handshake(l *link, scanner *bufio.Scanner) (linkEvent, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	l.send(linkEvent{Type: linkHello, Origin: srv.federation.id, Server: srv.name(), Nonce: hex.EncodeToString(nonce)})
+
+	hello, err := readLinkEvent(scanner, linkHello)
+	if err != nil {
+		return hello, err
+	}
+	if hello.Origin == "" || hello.Nonce == "" {
+		return hello, ErrLinkProtocol
+	}
+
+	mac := srv.linkMAC(hello.Nonce, srv.federation.id)
+	l.send(linkEvent{Type: linkAuth, MAC: hex.EncodeToString(mac)})
+
+	auth, err := readLinkEvent(scanner, linkAuth)
+	if err != nil {
+		return hello, err
+	}
+	want := hex.EncodeToString(srv.linkMAC(hex.EncodeToString(nonce), hello.Origin))
+	if subtle.ConstantTimeCompare([]byte(auth.MAC), []byte(want)) != 1 {
+		return hello, ErrLinkRejected
+	}
+
+	return hello, nil
+}
+
+// Exchange events with the server on the other end of `conn` until the
+// link drops.
+func (srv *Server) runLink(conn net.Conn) error {
+	if srv.LinkSecret == "" {
+		conn.Close()
+		return ErrNoLinkSecret
+	}
+
+	l := newLink(conn)
+	defer l.close()
+
+	if !srv.trackLink(l) {
+		return ErrServerClosed
+	}
+	defer srv.untrackLink(l)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, MaxLinkLineLength)
+
+	hello, err := srv.handshake(l, scanner)
+	if err != nil {
+		return err
+	}
+
+	if !srv.addLink(l, hello.Origin) {
+		return ErrLinkLoop
+	}
+	defer srv.dropLink(l)
+
+	log.Printf("Linked with %s (%s)\n", hello.Server, conn.RemoteAddr())
+
+	for scanner.Scan() {
+		var ev linkEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return ErrLinkProtocol
+		}
+		srv.handleLinkEvent(l, ev)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// ServeLinks accepts links from other servers on `ln`. Only servers
+// sharing the LinkSecret are let in.
+func (srv *Server) ServeLinks(ln net.Listener) error {
+	if srv.LinkSecret == "" {
+		ln.Close()
+		return ErrNoLinkSecret
+	}
+
+	if err := srv.start(); err != nil {
+		ln.Close()
+		return err
+	}
+
+	if !srv.trackListener(ln) {
+		ln.Close()
+		return ErrServerClosed
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.isClosing() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		log.Printf("New server link: %s\n", conn.RemoteAddr())
+
+		go func() {
+			err := srv.runLink(conn)
+			log.Printf("Server link %s dropped: %s\n", conn.RemoteAddr(), err)
+		}()
+	}
+}
+
+// Link to the server accepting links on `address` and share rooms with it
+// until the link drops.
+func (srv *Server) Link(address string) error {
+	if srv.LinkSecret == "" {
+		return ErrNoLinkSecret
+	}
+
+	if err := srv.start(); err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	return srv.runLink(conn)
+}
+
+// Keep a link to `address` up, reconnecting `retry` after it drops, until
+// the server shuts down.
+func (srv *Server) LinkForever(address string, retry time.Duration) {
+	for {
+		err := srv.Link(address)
+		if err == ErrServerClosed {
+			return
+		}
+		log.Printf("Link to %s dropped: %s\n", address, err)
+		if err == ErrNoLinkSecret {
+			return
+		}
+
+		select {
+		case <-time.After(retry):
+		case <-srv.quit:
+			return
+		}
+	}
+}
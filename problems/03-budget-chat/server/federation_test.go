@@ -0,0 +1,297 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+func newNamedServer(name string) *Server {
+	srv := NewServer()
+	srv.Name = name
+	srv.LinkSecret = "swordfish"
+	return srv
+}
+
+// Link `b` to `a` over loopback. The returned func drops the link.
+func linkServers(t *testing.T, a, b *Server) func() {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			a.runLink(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.runLink(conn)
+
+	t.Cleanup(func() { conn.Close() })
+	return func() { conn.Close() }
+}
+
+func TestFederation(t *testing.T) {
+	a, lnA := serveWith(t, newNamedServer("a"))
+	b, lnB := serveWith(t, newNamedServer("b"))
+
+	alice := dial(t, lnA)
+	alice.send("alice")
+	alice.expect("* This room is empty")
+
+	linkServers(t, a, b)
+	waitFor(t, hasClient(b, "alice"))
+
+	bob := dial(t, lnB)
+	bob.send("bob")
+	bob.expect("* This room contains: alice")
+	alice.expect("* bob has entered the room")
+
+	if err := b.join(client.NewVirtual("impostor"), "Alice"); err != ErrUsernameTaken {
+		t.Errorf("want %v have %v", ErrUsernameTaken, err)
+	}
+
+	tests := []struct {
+		from *user
+		to   *user
+		give string
+		want string
+	}{
+		{from: alice, to: bob, give: "hi bob", want: "[alice] hi bob"},
+		{from: bob, to: alice, give: "hello @alice", want: "[bob] hello @alice"},
+		{from: alice, to: alice, give: "/msg bob psst", want: "* bob is on another server, direct messages can't reach them"},
+		{from: bob, to: alice, give: "/nick robert", want: "* bob is now known as robert"},
+		{from: bob, to: alice, give: "/join dev", want: "* robert has left the room"},
+		{from: alice, to: bob, give: "/join dev", want: "* alice has entered the room"},
+	}
+
+	for _, test := range tests {
+		test.from.send(test.give)
+		test.to.readUntil(test.want)
+	}
+
+	alice.conn.Close()
+	bob.readUntil("* alice has left the room")
+	waitFor(t, func() bool { return !hasClient(b, "alice")() })
+}
+
+func TestFederationNameClash(t *testing.T) {
+	a, lnA := serveWith(t, newNamedServer("a"))
+	b, lnB := serveWith(t, newNamedServer("b"))
+
+	local := join(t, lnA, "alice")
+	remote := join(t, lnB, "alice")
+
+	linkServers(t, a, b)
+	waitFor(t, hasClient(a, "alice@b"))
+	waitFor(t, hasClient(b, "alice@a"))
+
+	remote.send("hi")
+	local.readUntil("[alice@b] hi")
+}
+
+func TestFederationResync(t *testing.T) {
+	a, lnA := serveWith(t, newNamedServer("a"))
+	b, lnB := serveWith(t, newNamedServer("b"))
+
+	alice := dial(t, lnA)
+	alice.send("alice")
+	alice.expect("* This room is empty")
+
+	bob := dial(t, lnB)
+	bob.send("bob")
+	bob.expect("* This room is empty")
+
+	drop := linkServers(t, a, b)
+	alice.expect("* bob has entered the room")
+	bob.expect("* alice has entered the room")
+
+	drop()
+	alice.expect("* bob has left the room")
+	bob.expect("* alice has left the room")
+
+	// Changes made while the link is down show up once it is back
+	bob.send("/join dev")
+	bob.expect("* This room is empty")
+	carol := dial(t, lnB)
+	carol.send("carol")
+	carol.expect("* This room is empty")
+
+	linkServers(t, a, b)
+	alice.expect("* carol has entered the room")
+	waitFor(t, hasClient(a, "bob"))
+	if r := a.currentRoom(a.findClient("bob")); r == nil || r.name != "dev" {
+		t.Errorf("want bob in dev have %v", r)
+	}
+}
+
+func TestFederationLoop(t *testing.T) {
+	a, lnA := serveWith(t, newNamedServer("a"))
+	b, lnB := serveWith(t, newNamedServer("b"))
+	c, lnC := serveWith(t, newNamedServer("c"))
+
+	linkServers(t, a, b)
+	linkServers(t, b, c)
+	dropCA := linkServers(t, c, a)
+
+	alice := join(t, lnA, "alice")
+	waitFor(t, hasClient(b, "alice"))
+	waitFor(t, hasClient(c, "alice"))
+
+	bob := join(t, lnB, "bob")
+	carol := join(t, lnC, "carol")
+	waitFor(t, hasClient(a, "carol"))
+	waitFor(t, hasClient(b, "carol"))
+
+	alice.send("one")
+	alice.send("two")
+
+	for _, u := range []*user{bob, carol} {
+		u.readUntil("[alice] one")
+		u.expect("[alice] two")
+	}
+
+	// Messages still get through, now by way of b
+	dropCA()
+	waitFor(t, func() bool {
+		a.federation.lock.Lock()
+		defer a.federation.lock.Unlock()
+		return len(a.federation.links) == 1
+	})
+	waitFor(t, hasClient(c, "alice"))
+
+	alice.send("three")
+	carol.readUntil("[alice] three")
+}
+
+func TestFederationWrongSecret(t *testing.T) {
+	a, lnA := serveWith(t, newNamedServer("a"))
+	b := newNamedServer("b")
+	b.LinkSecret = "hunter2"
+
+	join(t, lnA, "alice")
+
+	local, remote := net.Pipe()
+	errs := make(chan error, 2)
+	go func() { errs <- a.runLink(local) }()
+	go func() { errs <- b.runLink(remote) }()
+
+	rejected := false
+	for i := 0; i < 2; i++ {
+		switch err := <-errs; err {
+		case ErrLinkRejected:
+			rejected = true
+		case nil:
+			t.Error("want link to fail")
+		}
+	}
+	if !rejected {
+		t.Errorf("want %v", ErrLinkRejected)
+	}
+
+	if b.findClient("alice") != nil {
+		t.Error("want alice to stay unknown to b")
+	}
+	if n := len(a.federation.links) + len(b.federation.links); n != 0 {
+		t.Errorf("want no links have %d", n)
+	}
+}
+
+func TestFederationHandshake(t *testing.T) {
+	srv := newNamedServer("a")
+
+	// Proof of a peer with origin `origin` answering srv's hello
+	proof := func(secret, origin string) func(linkEvent) string {
+		return func(hello linkEvent) string {
+			peer := newNamedServer("peer")
+			peer.LinkSecret = secret
+			return hex.EncodeToString(peer.linkMAC(hello.Nonce, origin))
+		}
+	}
+
+	tests := []struct {
+		name  string
+		hello linkEvent
+		mac   func(linkEvent) string
+		want  error
+	}{
+		{
+			name:  "no nonce",
+			hello: linkEvent{Type: linkHello, Origin: "peer"},
+			want:  ErrLinkProtocol,
+		},
+		{
+			name:  "no auth",
+			hello: linkEvent{Type: linkHello, Origin: "peer", Nonce: "00"},
+			want:  io.EOF,
+		},
+		{
+			name:  "wrong secret",
+			hello: linkEvent{Type: linkHello, Origin: "peer", Nonce: "00"},
+			mac:   proof("hunter2", "peer"),
+			want:  ErrLinkRejected,
+		},
+		{
+			name:  "proof for another origin",
+			hello: linkEvent{Type: linkHello, Origin: "peer", Nonce: "00"},
+			mac:   proof("swordfish", "other"),
+			want:  ErrLinkRejected,
+		},
+	}
+
+	for _, test := range tests {
+		local, remote := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- srv.runLink(local) }()
+
+		events := json.NewDecoder(remote)
+		encoder := json.NewEncoder(remote)
+
+		var hello linkEvent
+		events.Decode(&hello)
+		encoder.Encode(test.hello)
+		if test.mac != nil {
+			encoder.Encode(linkEvent{Type: linkAuth, MAC: test.mac(hello)})
+		}
+
+		if test.want == io.EOF {
+			remote.Close()
+		} else {
+			go io.Copy(io.Discard, remote)
+		}
+
+		if err := <-errs; err != test.want {
+			t.Errorf("%s: want %v have %v", test.name, test.want, err)
+		}
+		remote.Close()
+	}
+}
+
+func TestFederationNoSecret(t *testing.T) {
+	srv := NewServer()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.ServeLinks(ln); err != ErrNoLinkSecret {
+		t.Errorf("want %v have %v", ErrNoLinkSecret, err)
+	}
+	if err := srv.Link(ln.Addr().String()); err != ErrNoLinkSecret {
+		t.Errorf("want %v have %v", ErrNoLinkSecret, err)
+	}
+}
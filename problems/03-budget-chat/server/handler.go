@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/accounts"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+const UsernamePrompt = "Welcome to budgetchat! What shall I call you?\n"
+
+const InvalidUsernameMessage = "Usernames must only contain ASCII letters, digits or underscores\n"
+
+const ReservedUsernameMessage = "This username is reserved\n"
+
+const TakenUsernameMessage = "This username is already taken\n"
+
+const BannedUsernameMessage = "This username is banned\n"
+
+const PasswordPrompt = "This username is registered, what's the password?\n"
+
+const WrongPasswordMessage = "Wrong password\n"
+
+const TooManyFailuresMessage = "Too many wrong passwords, try again later\n"
+
+// Format of the notice sent in response to an overlong line.
+const LineTooLongMessage = "* Message too long, the limit is %d bytes\n"
+
+func usernameErrorMessage(err error) string {
+	switch err {
+	case ErrUsernameReserved:
+		return ReservedUsernameMessage
+	case ErrUsernameTaken:
+		return TakenUsernameMessage
+	case ErrUsernameBanned:
+		return BannedUsernameMessage
+	case accounts.ErrWrongPassword:
+		return WrongPasswordMessage
+	case ErrTooManyFailures:
+		return TooManyFailuresMessage
+	default:
+		return InvalidUsernameMessage
+	}
+}
+
+// HandleClient speaks the budget-chat protocol: it prompts for a username,
+// joins the client and forwards every line they send as a message.
+func HandleClient(c *client.Client, messageChan chan<- *client.Message, join func(string) error) error {
+	if err := c.Write([]byte(UsernamePrompt)); err != nil {
+		return err
+	}
+
+	username, _ := c.Read()
+	if err := join(string(username)); err != nil {
+		log.Printf("Client %s provided a bad username: %s\n", c.RemoteAddr(), err)
+		if err := c.Write([]byte(usernameErrorMessage(err))); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	for {
+		text, err := c.Read()
+		if err == client.ErrLineTooLong {
+			if err := c.Write([]byte(fmt.Sprintf(LineTooLongMessage, c.MaxLineLength))); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			// Connection may also be closed by the server, e.g. on /kick
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				break
+			}
+
+			return err
+		}
+
+		msg := client.NewMessage(string(text), c)
+		messageChan <- msg
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+// Ring buffer holding the last messages relayed in a room.
+type history struct {
+	lines []string
+	next  int
+	full  bool
+}
+
+func newHistory(size int) *history {
+	return &history{
+		lines: make([]string, size),
+	}
+}
+
+func (h *history) add(line string) {
+	if len(h.lines) == 0 {
+		return
+	}
+
+	h.lines[h.next] = line
+	h.next = (h.next + 1) % len(h.lines)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Buffered lines, oldest first.
+func (h *history) snapshot() []string {
+	if !h.full {
+		return append([]string{}, h.lines[:h.next]...)
+	}
+	return append(append([]string{}, h.lines[h.next:]...), h.lines[:h.next]...)
+}
+
+// Remember a line relayed in `room`.
+func (srv *Server) recordHistory(room string, line string) {
+	if srv.HistorySize <= 0 {
+		return
+	}
+
+	srv.historyLock.Lock()
+	h, ok := srv.history[room]
+	if !ok {
+		h = newHistory(srv.HistorySize)
+		srv.history[room] = h
+	}
+	h.add(line)
+	srv.historyLock.Unlock()
+
+	if srv.HistoryFile != "" {
+		// Coalesce saves while one is already pending
+		select {
+		case srv.historyDirty <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Send the buffered history of `room` to a client that just entered it.
+// Caller must hold `srv.clientLock`, so that messages relayed meanwhile are
+// either in the history or sent to the client, not both.
+func (srv *Server) replayHistoryLocked(room string, c *client.Client) {
+	srv.historyLock.Lock()
+	h, ok := srv.history[room]
+	if !ok {
+		srv.historyLock.Unlock()
+		return
+	}
+	lines := h.snapshot()
+	srv.historyLock.Unlock()
+
+	if len(lines) == 0 {
+		return
+	}
+
+	// Queue the whole history as a single write so that replaying it
+	// can't overflow the client's send queue.
+	var data []byte
+	for _, line := range lines {
+		data = append(append(data, line...), '\n')
+	}
+	srv.send(c, data)
+}
+
+// Load history saved by a previous run from `srv.HistoryFile`.
+func (srv *Server) loadHistory() error {
+	data, err := os.ReadFile(srv.HistoryFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	saved := map[string][]string{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	srv.historyLock.Lock()
+	defer srv.historyLock.Unlock()
+
+	for room, lines := range saved {
+		h := newHistory(srv.HistorySize)
+		for _, line := range lines {
+			h.add(line)
+		}
+		srv.history[room] = h
+	}
+
+	return nil
+}
+
+// Atomically replace `srv.HistoryFile` with the current history.
+func (srv *Server) saveHistory() error {
+	srv.historyLock.Lock()
+	saved := map[string][]string{}
+	for room, h := range srv.history {
+		saved[room] = h.snapshot()
+	}
+	srv.historyLock.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(srv.HistoryFile), ".history-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), srv.HistoryFile)
+}
+
+// Write history to disk whenever it changes.
+func (srv *Server) persistHistory() {
+	defer srv.workers.Done()
+
+	for {
+		select {
+		case <-srv.historyDirty:
+			if err := srv.saveHistory(); err != nil {
+				log.Printf("ERROR: Failed to save history: %s\n", err)
+			}
+		case <-srv.quit:
+			// Shutdown saves the final state
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+func TestHistory(t *testing.T) {
+	tests := []struct {
+		size int
+		give []string
+		want []string
+	}{
+		{size: 3, give: []string{}, want: []string{}},
+		{size: 3, give: []string{"a", "b"}, want: []string{"a", "b"}},
+		{size: 3, give: []string{"a", "b", "c"}, want: []string{"a", "b", "c"}},
+		{size: 3, give: []string{"a", "b", "c", "d", "e"}, want: []string{"c", "d", "e"}},
+		{size: 0, give: []string{"a"}, want: []string{}},
+	}
+
+	for _, test := range tests {
+		h := newHistory(test.size)
+		for _, line := range test.give {
+			h.add(line)
+		}
+
+		if have := h.snapshot(); !slices.Equal(have, test.want) {
+			t.Errorf("want %v have %v", test.want, have)
+		}
+	}
+}
+
+func TestHistoryPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+
+	srv := NewServer()
+	srv.HistorySize = 2
+	srv.HistoryFile = path
+
+	srv.recordHistory(DefaultRoom, "[alice] one")
+	srv.recordHistory(DefaultRoom, "[alice] two")
+	srv.recordHistory(DefaultRoom, "[bob] three")
+	srv.recordHistory("dev", "[carol] hi")
+
+	if err := srv.saveHistory(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewServer()
+	restarted.HistorySize = 2
+	restarted.HistoryFile = path
+
+	if err := restarted.loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		room string
+		want []string
+	}{
+		{room: DefaultRoom, want: []string{"[alice] two", "[bob] three"}},
+		{room: "dev", want: []string{"[carol] hi"}},
+	}
+
+	for _, test := range tests {
+		if have := restarted.history[test.room].snapshot(); !slices.Equal(have, test.want) {
+			t.Errorf("%s: want %v have %v", test.room, test.want, have)
+		}
+	}
+}
+
+func TestScenarioHistoryWhileJoining(t *testing.T) {
+	srv := NewServer()
+	srv.HistorySize = 1000
+	srv.QueueSize = 1000
+	// Give messages time to be relayed while the joins are under way
+	srv.Hooks = append(srv.Hooks, Hooks{
+		Join: func(c *client.Client, room string) { time.Sleep(5 * time.Millisecond) },
+	})
+	_, ln := serveWith(t, srv)
+
+	const count = 300
+	alice := join(t, ln, "alice")
+	go func() {
+		for i := 1; i <= count; i++ {
+			fmt.Fprintf(alice.conn, "%d\n", i)
+		}
+		alice.conn.Write([]byte("done\n"))
+	}()
+
+	// Everyone joining meanwhile sees each message once and in order,
+	// whether from the history or live
+	users := []*user{}
+	for i := 0; i < 5; i++ {
+		u := dial(t, ln)
+		u.send(fmt.Sprint("user", i))
+		users = append(users, u)
+	}
+
+	for i, u := range users {
+		last := 0
+		for line := u.read(); line != "[alice] done"; line = u.read() {
+			if strings.HasPrefix(line, "* ") {
+				continue
+			}
+			n, err := strconv.Atoi(strings.TrimPrefix(line, "[alice] "))
+			if err != nil || n != last+1 {
+				t.Fatalf("user%d: want [alice] %d have %q", i, last+1, line)
+			}
+			last = n
+		}
+		if last != count {
+			t.Errorf("user%d: want %d messages have %d", i, count, last)
+		}
+	}
+}
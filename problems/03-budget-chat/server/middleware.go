@@ -0,0 +1,84 @@
+package server
+
+import (
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+// Middleware wraps a ClientHandler, e.g. to log connections or to check
+// usernames before passing them on to `join`.
+type Middleware func(next ClientHandler) ClientHandler
+
+// Chain wraps `handler` in `middleware`, the first one being outermost.
+func Chain(handler ClientHandler, middleware ...Middleware) ClientHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Processes a single inbound message.
+type MessageHandler func(msg *client.Message)
+
+// MessageMiddleware wraps the processing of inbound messages. It may pass
+// the message on to `next` unchanged, replace it or drop it altogether.
+type MessageMiddleware func(next MessageHandler) MessageHandler
+
+// Hooks observe chat activity. Any of them may be nil. They run on the
+// goroutine that caused the event and must not block.
+type Hooks struct {
+	// Client entered `room`
+	Join func(c *client.Client, room string)
+
+	// Client sent `msg` to everyone in `room`
+	Message func(msg *client.Message, room string)
+
+	// Client left `room`
+	Leave func(c *client.Client, room string)
+}
+
+func (srv *Server) runJoinHooks(c *client.Client, room string) {
+	for _, h := range srv.Hooks {
+		if h.Join != nil {
+			h.Join(c, room)
+		}
+	}
+}
+
+func (srv *Server) runMessageHooks(msg *client.Message, room string) {
+	for _, h := range srv.Hooks {
+		if h.Message != nil {
+			h.Message(msg, room)
+		}
+	}
+}
+
+func (srv *Server) runLeaveHooks(c *client.Client, room string) {
+	for _, h := range srv.Hooks {
+		if h.Leave != nil {
+			h.Leave(c, room)
+		}
+	}
+}
+
+// Run a chat command or relay the message to the sender's room.
+func (srv *Server) handleMessage(msg *client.Message) {
+	msg.Sender.Touch()
+
+	// Bots often repeat what others said, which mustn't make them run commands
+	if !srv.isBot(msg.Sender) && srv.runCommand(msg) {
+		return
+	}
+
+	if r := srv.currentRoom(msg.Sender); r != nil {
+		srv.relayToRoom(r, msg)
+	}
+}
+
+// Wrap handleMessage in the configured message middleware.
+func (srv *Server) messageHandler() MessageHandler {
+	handler := MessageHandler(srv.handleMessage)
+	for i := len(srv.MessageMiddleware) - 1; i >= 0; i-- {
+		handler = srv.MessageMiddleware[i](handler)
+	}
+	return handler
+}
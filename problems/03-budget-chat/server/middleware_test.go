@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+func TestChain(t *testing.T) {
+	calls := []string{}
+	trace := func(name string) Middleware {
+		return func(next ClientHandler) ClientHandler {
+			return func(c *client.Client, messageChan chan<- *client.Message, join func(string) error) error {
+				calls = append(calls, name+" before")
+				err := next(c, messageChan, join)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+
+	handler := Chain(func(c *client.Client, messageChan chan<- *client.Message, join func(string) error) error {
+		calls = append(calls, "handler")
+		return nil
+	}, trace("outer"), trace("inner"))
+
+	handler(nil, nil, nil)
+
+	want := []string{"outer before", "inner before", "handler", "inner after", "outer after"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("want %v have %v", want, calls)
+	}
+}
+
+func TestMiddlewareWrapsJoin(t *testing.T) {
+	errNoAdmins := errors.New("no admins")
+	noAdmins := func(next ClientHandler) ClientHandler {
+		return func(c *client.Client, messageChan chan<- *client.Message, join func(string) error) error {
+			return next(c, messageChan, func(username string) error {
+				if strings.HasPrefix(username, "admin") {
+					return errNoAdmins
+				}
+				return join(username)
+			})
+		}
+	}
+
+	_, ln := serveHandler(t, NewServer(), Chain(HandleClient, noAdmins))
+
+	u := dial(t, ln)
+	u.send("admin1")
+	u.expect(strings.TrimSuffix(InvalidUsernameMessage, "\n"))
+	u.expectClosed()
+}
+
+func TestMessageMiddleware(t *testing.T) {
+	srv := NewServer()
+	srv.MessageMiddleware = []MessageMiddleware{
+		// Drop messages shouting in capitals
+		func(next MessageHandler) MessageHandler {
+			return func(msg *client.Message) {
+				if msg.Text != strings.ToUpper(msg.Text) {
+					next(msg)
+				}
+			}
+		},
+		// Censor a word
+		func(next MessageHandler) MessageHandler {
+			return func(msg *client.Message) {
+				next(client.NewMessage(strings.ReplaceAll(msg.Text, "darn", "****"), msg.Sender))
+			}
+		},
+	}
+	_, ln := serveWith(t, srv)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+
+	alice.send("HELLO")
+	alice.send("darn it")
+	bob.expect("[alice] **** it")
+
+	bob.send("/rooms")
+	bob.expect("* Rooms: lobby (2)")
+}
+
+func TestHooks(t *testing.T) {
+	events := make(chan string, 16)
+
+	srv := NewServer()
+	srv.Hooks = []Hooks{
+		{
+			Join: func(c *client.Client, room string) {
+				events <- "join " + c.Username() + " " + room
+			},
+			Leave: func(c *client.Client, room string) {
+				events <- "leave " + c.Username() + " " + room
+			},
+		},
+		{
+			Message: func(msg *client.Message, room string) {
+				events <- "message " + msg.Sender.Username() + " " + room + " " + msg.Text
+			},
+		},
+	}
+
+	_, ln := serveWith(t, srv)
+
+	alice := join(t, ln, "alice")
+	alice.send("hello")
+	alice.send("/join dev")
+	alice.expect("* This room is empty")
+	alice.send("/msg alice note to self")
+	alice.expect("[alice -> alice] note to self")
+	alice.conn.Close()
+
+	want := []string{
+		"join alice lobby",
+		"message alice lobby hello",
+		"leave alice lobby",
+		"join alice dev",
+		"leave alice dev",
+	}
+	for _, w := range want {
+		if have := <-events; have != w {
+			t.Errorf("want %q have %q", w, have)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+const (
+	BannedMessage   = "* You are banned from this server\n"
+	FloodingMessage = "* Disconnected for flooding\n"
+)
+
+var ErrUsernameBanned = errors.New("username is banned")
+
+// Flooding warnings are forgotten once a client goes this long without one.
+const RateWarningExpiry = 10 * time.Minute
+
+// Token bucket limiting how often a client may send messages.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// Number of times the client was warned for exceeding the limit, the
+	// last time at `warned`
+	warnings int
+	warned   time.Time
+}
+
+func newRateLimiter(rate float64, burst int, now time.Time) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (rl *rateLimiter) allow(now time.Time) bool {
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
+
+// Count a warning given at `now` and return the number of recent ones.
+func (rl *rateLimiter) warn(now time.Time) int {
+	if now.Sub(rl.warned) >= RateWarningExpiry {
+		rl.warnings = 0
+	}
+	rl.warnings++
+	rl.warned = now
+	return rl.warnings
+}
+
+// Moderation state: operators, bans, mutes and flood control.
+type moderation struct {
+	lock sync.Mutex
+
+	operators   map[*client.Client]bool
+	muted       map[string]bool
+	bannedNames map[string]bool
+	bannedIPs   map[string]bool
+	limiters    map[*client.Client]*rateLimiter
+
+	// Wrong passwords by address, see MaxPasswordFailures
+	failures map[string]*passwordFailures
+}
+
+func newModeration() *moderation {
+	return &moderation{
+		operators:   map[*client.Client]bool{},
+		muted:       map[string]bool{},
+		bannedNames: map[string]bool{},
+		bannedIPs:   map[string]bool{},
+		limiters:    map[*client.Client]*rateLimiter{},
+		failures:    map[string]*passwordFailures{},
+	}
+}
+
+func (m *moderation) isOperator(c *client.Client) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.operators[c]
+}
+
+func (m *moderation) isMuted(username string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.muted[strings.ToLower(username)]
+}
+
+func (m *moderation) isNameBanned(username string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.bannedNames[strings.ToLower(username)]
+}
+
+func (m *moderation) isAddrBanned(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == "" {
+		return false
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.bannedIPs[ip]
+}
+
+// Forget everything tied to a disconnected client.
+func (m *moderation) forget(c *client.Client) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.operators, c)
+	delete(m.limiters, c)
+}
+
+// IP address part of `addr`, or an empty string for non IP transports.
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// Apply flood control and mutes to an inbound message. Returns false if
+// the message must be dropped.
+func (srv *Server) screen(msg *client.Message) bool {
+	c := msg.Sender
+
+	if srv.RateLimit > 0 {
+		srv.moderation.lock.Lock()
+		rl, ok := srv.moderation.limiters[c]
+		if !ok {
+			rl = newRateLimiter(srv.RateLimit, srv.RateBurst, time.Now())
+			srv.moderation.limiters[c] = rl
+		}
+		now := time.Now()
+		allowed := rl.allow(now)
+		var warnings int
+		if !allowed {
+			warnings = rl.warn(now)
+		}
+		srv.moderation.lock.Unlock()
+
+		switch {
+		case allowed:
+		case warnings <= srv.RateWarnings:
+			srv.notice(c, "You are sending messages too fast, slow down")
+			return false
+		case warnings == srv.RateWarnings+1:
+			log.Printf("Disconnecting %s for flooding\n", c.RemoteAddr())
+			srv.send(c, []byte(FloodingMessage))
+			go c.Close()
+			return false
+		default:
+			// Already being disconnected
+			return false
+		}
+	}
+
+	// Muted users may still run commands, except for talking privately or
+	// dodging the mute by changing their name or away message
+	if name, _, isCommand := parseCommand(msg.Text); (!isCommand || name == "msg" || name == "nick" || name == "away") && srv.moderation.isMuted(c.Username()) {
+		srv.notice(c, "You are muted")
+		return false
+	}
+
+	return true
+}
+
+// Read messages sent by client handlers and pass those that make it through
+// moderation on to `srv.relayMessages`.
+func (srv *Server) screenMessages() {
+	defer srv.workers.Done()
+	defer close(srv.messageChan)
+
+	for msg := range srv.inbox {
+		if srv.sanitize(msg) && srv.screen(msg) {
+			srv.messageChan <- msg
+		}
+	}
+}
+
+// Disconnect a client, telling them why.
+func (srv *Server) kick(c *client.Client, reason string) {
+	srv.notice(c, reason)
+	go c.Close()
+}
+
+// Reply with an error and return false unless `c` is an operator.
+func (srv *Server) requireOperator(c *client.Client) bool {
+	if srv.moderation.isOperator(c) {
+		return true
+	}
+	srv.notice(c, "Permission denied")
+	return false
+}
+
+// /oper <password>
+func operCommand(srv *Server, c *client.Client, args string) {
+	if srv.moderation.tooManyFailures(c.RemoteAddr(), time.Now()) {
+		srv.kickForFailures(c)
+		return
+	}
+
+	password, ok := srv.Operators[c.Username()]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(args)) != 1 {
+		srv.wrongPassword(c, "Permission denied")
+		return
+	}
+	srv.moderation.passwordSucceeded(c.RemoteAddr())
+
+	srv.moderation.lock.Lock()
+	srv.moderation.operators[c] = true
+	srv.moderation.lock.Unlock()
+
+	srv.notice(c, "You are now an operator")
+}
+
+// /kick <user>
+func kickCommand(srv *Server, c *client.Client, args string) {
+	if !srv.requireOperator(c) {
+		return
+	}
+
+	target := srv.findClient(args)
+	if target == nil {
+		srv.notice(c, "No such user: "+args)
+		return
+	}
+
+	srv.kick(target, "You have been kicked by "+c.Username())
+	srv.notice(c, "Kicked "+target.Username())
+}
+
+// /ban <user|ip>
+func banCommand(srv *Server, c *client.Client, args string) {
+	if !srv.requireOperator(c) {
+		return
+	}
+
+	ip := net.ParseIP(args)
+
+	// Look up who to disconnect before touching the ban lists, as the
+	// client registry must not be locked while holding the moderation lock.
+	targets := []*client.Client{}
+	if ip != nil {
+		srv.clientLock.RLock()
+		for _, other := range srv.clients {
+			if addrIP(other.RemoteAddr()) == ip.String() {
+				targets = append(targets, other)
+			}
+		}
+		srv.clientLock.RUnlock()
+	} else if target := srv.findClient(args); target != nil {
+		targets = append(targets, target)
+	}
+
+	srv.moderation.lock.Lock()
+	if ip != nil {
+		srv.moderation.bannedIPs[ip.String()] = true
+	} else {
+		srv.moderation.bannedNames[strings.ToLower(args)] = true
+		for _, target := range targets {
+			if targetIP := addrIP(target.RemoteAddr()); targetIP != "" {
+				srv.moderation.bannedIPs[targetIP] = true
+			}
+		}
+	}
+	srv.moderation.lock.Unlock()
+
+	for _, target := range targets {
+		srv.kick(target, "You have been banned by "+c.Username())
+	}
+	srv.notice(c, "Banned "+args)
+}
+
+// /unban <user|ip>
+func unbanCommand(srv *Server, c *client.Client, args string) {
+	if !srv.requireOperator(c) {
+		return
+	}
+
+	srv.moderation.lock.Lock()
+	if ip := net.ParseIP(args); ip != nil {
+		delete(srv.moderation.bannedIPs, ip.String())
+	} else {
+		delete(srv.moderation.bannedNames, strings.ToLower(args))
+	}
+	srv.moderation.lock.Unlock()
+
+	srv.notice(c, "Unbanned "+args)
+}
+
+// /mute <user>
+func muteCommand(srv *Server, c *client.Client, args string) {
+	setMuted(srv, c, args, true)
+}
+
+// /unmute <user>
+func unmuteCommand(srv *Server, c *client.Client, args string) {
+	setMuted(srv, c, args, false)
+}
+
+func setMuted(srv *Server, c *client.Client, username string, muted bool) {
+	if !srv.requireOperator(c) {
+		return
+	}
+
+	target := srv.findClient(username)
+	if target == nil {
+		srv.notice(c, "No such user: "+username)
+		return
+	}
+
+	srv.moderation.lock.Lock()
+	if muted {
+		srv.moderation.muted[strings.ToLower(target.Username())] = true
+	} else {
+		delete(srv.moderation.muted, strings.ToLower(target.Username()))
+	}
+	srv.moderation.lock.Unlock()
+
+	if muted {
+		srv.notice(target, "You have been muted by "+c.Username())
+		srv.notice(c, "Muted "+target.Username())
+	} else {
+		srv.notice(target, "You have been unmuted by "+c.Username())
+		srv.notice(c, "Unmuted "+target.Username())
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(0, 0)
+	rl := newRateLimiter(1, 2, start)
+
+	tests := []struct {
+		after time.Duration
+		want  bool
+	}{
+		{after: 0, want: true},
+		{after: 0, want: true},
+		{after: 0, want: false},
+		{after: 500 * time.Millisecond, want: false},
+		{after: time.Second, want: true},
+		{after: time.Second, want: false},
+		{after: 10 * time.Second, want: true},
+		{after: 10 * time.Second, want: true},
+		{after: 10 * time.Second, want: false},
+	}
+
+	for i, test := range tests {
+		if allowed := rl.allow(start.Add(test.after)); allowed != test.want {
+			t.Errorf("%d: want %v have %v", i, test.want, allowed)
+		}
+	}
+}
+
+func TestRateLimiterWarnings(t *testing.T) {
+	start := time.Unix(0, 0)
+	rl := newRateLimiter(1, 1, start)
+
+	tests := []struct {
+		after time.Duration
+		want  int
+	}{
+		{after: 0, want: 1},
+		{after: time.Minute, want: 2},
+		{after: time.Minute + RateWarningExpiry - time.Second, want: 3},
+		{after: 2*time.Minute + 2*RateWarningExpiry, want: 1},
+	}
+
+	for i, test := range tests {
+		if warnings := rl.warn(start.Add(test.after)); warnings != test.want {
+			t.Errorf("%d: want %d have %d", i, test.want, warnings)
+		}
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	tests := []struct {
+		give net.Addr
+		want string
+	}{
+		{give: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}, want: "10.0.0.1"},
+		{give: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1234}, want: "::1"},
+		{give: &net.UnixAddr{Name: "/tmp/chat.sock"}, want: ""},
+	}
+
+	for _, test := range tests {
+		if ip := addrIP(test.give); ip != test.want {
+			t.Errorf("%s: want %q have %q", test.give, test.want, ip)
+		}
+	}
+}
+
+// Serve `srv` with an operator `op` and a regular user `bob`, both joined.
+func moderate(t *testing.T, srv *Server) (*user, *user) {
+	t.Helper()
+
+	srv.Operators["op"] = "secret"
+	_, ln := serveWith(t, srv)
+
+	op := join(t, ln, "op")
+	bob := join(t, ln, "bob")
+	op.expect("* bob has entered the room")
+
+	return op, bob
+}
+
+// Like moderate, with `op` already an operator.
+func moderateAsOper(t *testing.T, srv *Server) (*user, *user) {
+	t.Helper()
+
+	op, bob := moderate(t, srv)
+	op.send("/oper secret")
+	op.expect("* You are now an operator")
+
+	return op, bob
+}
+
+func TestOperCommand(t *testing.T) {
+	op, bob := moderate(t, NewServer())
+
+	tests := []struct {
+		u    *user
+		give string
+		want string
+	}{
+		{u: op, give: "/kick bob", want: "* Permission denied"},
+		{u: op, give: "/oper wrong", want: "* Permission denied"},
+		{u: bob, give: "/oper secret", want: "* Permission denied"},
+		{u: op, give: "/oper secret", want: "* You are now an operator"},
+		{u: op, give: "/mute nobody", want: "* No such user: nobody"},
+		{u: op, give: "/unmute BOB", want: "* Unmuted bob"},
+	}
+
+	for _, test := range tests {
+		test.u.send(test.give)
+		test.u.expect(test.want)
+	}
+}
+
+func TestOperFailures(t *testing.T) {
+	srv := NewServer()
+	srv.Operators["op"] = "secret"
+	_, ln := serveWith(t, srv)
+
+	op := join(t, ln, "op")
+	for i := 1; i < MaxPasswordFailures; i++ {
+		op.send("/oper wrong")
+		op.expect("* Permission denied")
+	}
+	op.send("/oper wrong")
+	op.expect("* " + strings.TrimSuffix(TooManyFailuresMessage, "\n"))
+	op.expectClosed()
+	waitFor(t, func() bool { return !hasClient(srv, "op")() })
+
+	// Not even the right password helps anymore
+	op = join(t, ln, "op")
+	op.send("/oper secret")
+	op.expect("* " + strings.TrimSuffix(TooManyFailuresMessage, "\n"))
+	op.expectClosed()
+}
+
+func TestMuteCommand(t *testing.T) {
+	op, bob := moderateAsOper(t, NewServer())
+
+	// Usernames are matched regardless of case
+	op.send("/mute Bob")
+	bob.expect("* You have been muted by op")
+	op.expect("* Muted bob")
+
+	tests := []struct {
+		give string
+		want string
+	}{
+		{give: "hello", want: "* You are muted"},
+		{give: "/msg op hello", want: "* You are muted"},
+		{give: "/nick robert", want: "* You are muted"},
+		{give: "/away spam", want: "* You are muted"},
+		{give: "/rooms", want: "* Rooms: " + DefaultRoom + " (2)"},
+	}
+
+	for _, test := range tests {
+		bob.send(test.give)
+		bob.expect(test.want)
+	}
+	op.expectSilence()
+
+	op.send("/unmute bob")
+	bob.expect("* You have been unmuted by op")
+
+	bob.send("hello")
+	op.readUntil("[bob] hello")
+}
+
+func TestKickCommand(t *testing.T) {
+	op, bob := moderateAsOper(t, NewServer())
+
+	op.send("/kick BOB")
+	bob.expect("* You have been kicked by op")
+	op.expect("* Kicked bob")
+	bob.expectClosed()
+}
+
+func TestBanCommand(t *testing.T) {
+	srv := NewServer()
+	op, bob := moderateAsOper(t, srv)
+
+	op.send("/ban bob")
+	bob.expect("* You have been banned by op")
+	op.expect("* Banned bob")
+
+	// Banned client is disconnected
+	bob.expectClosed()
+	op.expect("* bob has left the room")
+	waitFor(t, func() bool { return !hasClient(srv, "bob")() })
+
+	if err := srv.join(client.NewVirtual("again"), "BOB"); err != ErrUsernameBanned {
+		t.Errorf("want %v have %v", ErrUsernameBanned, err)
+	}
+
+	op.send("/ban 192.0.2.1")
+	op.expect("* Banned 192.0.2.1")
+	if !srv.moderation.isAddrBanned(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Error("expected address to be banned")
+	}
+}
+
+func TestFloodControl(t *testing.T) {
+	srv := NewServer()
+	srv.RateLimit = 0.001
+	srv.RateBurst = 1
+	srv.RateWarnings = 1
+	op, bob := moderate(t, srv)
+
+	bob.send("one")
+	op.expect("[bob] one")
+
+	bob.send("two")
+	bob.expect("* You are sending messages too fast, slow down")
+
+	bob.send("three")
+	bob.expect(strings.TrimSuffix(FloodingMessage, "\n"))
+	bob.expectClosed()
+	op.expect("* bob has left the room")
+}
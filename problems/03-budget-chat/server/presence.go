@@ -0,0 +1,65 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+// Describe a member of the room for /who.
+func describePresence(username string, p client.Presence, now time.Time) string {
+	var b strings.Builder
+	b.WriteString(username)
+
+	if !p.JoinedAt.IsZero() {
+		b.WriteString(", joined ")
+		b.WriteString(p.JoinedAt.Format(time.DateTime))
+	}
+
+	b.WriteString(", idle ")
+	b.WriteString(p.Idle(now).Truncate(time.Second).String())
+
+	if p.Away != "" {
+		b.WriteString(", away: ")
+		b.WriteString(p.Away)
+	}
+
+	return b.String()
+}
+
+// /who
+func whoCommand(srv *Server, c *client.Client, args string) {
+	r := srv.currentRoom(c)
+	if r == nil {
+		return
+	}
+
+	now := time.Now()
+	srv.notice(c, "Members of "+r.name+":")
+	for _, member := range srv.roomMembers(r) {
+		username := member.Username()
+		if member == c {
+			username += " (you)"
+		}
+		srv.notice(c, describePresence(username, member.Presence(), now))
+	}
+}
+
+// /away [message]
+func awayCommand(srv *Server, c *client.Client, args string) {
+	c.SetAway(args)
+
+	if args == "" {
+		srv.notice(c, "You are no longer marked as away")
+	} else {
+		srv.notice(c, "You are now marked as away")
+	}
+}
+
+// Let the sender of a direct message know that `recipient` is away.
+func (srv *Server) replyAway(sender, recipient *client.Client) {
+	if away := recipient.Presence().Away; away != "" {
+		srv.notice(sender, recipient.Username()+" is away: "+away)
+	}
+}
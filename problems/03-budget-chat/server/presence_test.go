@@ -0,0 +1,79 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+func TestDescribePresence(t *testing.T) {
+	joined := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := joined.Add(time.Hour)
+
+	tests := []struct {
+		give client.Presence
+		want string
+	}{
+		{
+			give: client.Presence{JoinedAt: joined, LastActive: now.Add(-90*time.Second - time.Millisecond)},
+			want: "alice, joined 2024-03-01 12:00:00, idle 1m30s",
+		},
+		{
+			give: client.Presence{JoinedAt: joined, LastActive: now, Away: "lunch"},
+			want: "alice, joined 2024-03-01 12:00:00, idle 0s, away: lunch",
+		},
+		{
+			give: client.Presence{LastActive: now.Add(time.Second)},
+			want: "alice, idle 0s",
+		},
+	}
+
+	for _, test := range tests {
+		if have := describePresence("alice", test.give, now); have != test.want {
+			t.Errorf("want %q have %q", test.want, have)
+		}
+	}
+}
+
+func TestAwayCommand(t *testing.T) {
+	_, ln := serve(t)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+
+	alice.send("/away lunch")
+	alice.expect("* You are now marked as away")
+
+	bob.send("/msg alice hi")
+	alice.expect("[bob -> alice] hi")
+	bob.expect("* alice is away: lunch")
+
+	bob.send("/who")
+	tests := []struct {
+		prefix string
+		suffix string
+	}{
+		{prefix: "* Members of " + DefaultRoom + ":"},
+		{prefix: "* alice, joined ", suffix: ", away: lunch"},
+		{prefix: "* bob (you), joined ", suffix: ", idle 0s"},
+	}
+	for _, test := range tests {
+		line := bob.read()
+		if !strings.HasPrefix(line, test.prefix) || !strings.HasSuffix(line, test.suffix) {
+			t.Errorf("want %q...%q have %q", test.prefix, test.suffix, line)
+		}
+	}
+
+	alice.send("/away")
+	alice.expect("* You are no longer marked as away")
+
+	bob.send("/msg alice back?")
+	alice.expect("[bob -> alice] back?")
+	bob.send("/rooms")
+	if line := bob.read(); !strings.HasPrefix(line, "* Rooms: ") {
+		t.Errorf("want no auto-reply have %q", line)
+	}
+}
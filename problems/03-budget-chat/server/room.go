@@ -0,0 +1,124 @@
+package server
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/transcript"
+)
+
+// Room every client is placed in after joining. Plain Protohackers clients
+// never leave it, so for them the server behaves as a single chat room.
+const DefaultRoom = "lobby"
+
+const MaxRoomNameLength = 32
+
+type room struct {
+	name    string
+	members []*client.Client
+}
+
+func newRoom(name string) *room {
+	return &room{
+		name:    name,
+		members: []*client.Client{},
+	}
+}
+
+func isRoomNameValid(name string) bool {
+	if len(name) == 0 || len(name) > MaxRoomNameLength {
+		return false
+	}
+
+	for _, b := range []byte(name) {
+		if !((b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '_' || b == '-') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (srv *Server) roomMembers(r *room) []*client.Client {
+	srv.clientLock.RLock()
+	defer srv.clientLock.RUnlock()
+
+	return slices.Clone(r.members)
+}
+
+func (srv *Server) currentRoom(c *client.Client) *room {
+	srv.clientLock.RLock()
+	defer srv.clientLock.RUnlock()
+
+	return srv.membership[c]
+}
+
+// Move client into the room called `name`, creating it if needed,
+// and introduce them to its members.
+func (srv *Server) enterRoom(c *client.Client, name string) {
+	srv.leaveRoom(c)
+
+	srv.clientLock.Lock()
+	r, ok := srv.rooms[name]
+	if !ok {
+		r = newRoom(name)
+		srv.rooms[name] = r
+	}
+	// Queued before anything the room sees afterwards can reach the client
+	srv.listMembersLocked(r, c)
+	srv.replayHistoryLocked(r.name, c)
+	r.members = append(r.members, c)
+	srv.membership[c] = r
+	srv.clientLock.Unlock()
+
+	srv.record(transcript.Join, r.name, c.Username(), "")
+	srv.runJoinHooks(c, r.name)
+	srv.federate(c, linkEvent{Type: linkJoin, User: c.Username(), Room: r.name})
+
+	srv.announceMembership(r, c, false)
+}
+
+// Take client out of their current room, if any, and inform the
+// remaining members. Empty rooms other than the default one are dropped.
+func (srv *Server) leaveRoom(c *client.Client) {
+	srv.clientLock.Lock()
+	r, ok := srv.membership[c]
+	if !ok {
+		srv.clientLock.Unlock()
+		return
+	}
+
+	delete(srv.membership, c)
+	idx := slices.Index(r.members, c)
+	r.members = slices.Delete(r.members, idx, idx+1)
+	if len(r.members) == 0 && r.name != DefaultRoom {
+		delete(srv.rooms, r.name)
+	}
+	srv.clientLock.Unlock()
+
+	srv.record(transcript.Leave, r.name, c.Username(), "")
+	srv.runLeaveHooks(c, r.name)
+
+	srv.announceMembership(r, c, true /* leaving */)
+}
+
+// Describe all rooms along with their member count.
+func (srv *Server) listRooms() string {
+	srv.clientLock.RLock()
+	defer srv.clientLock.RUnlock()
+
+	names := make([]string, 0, len(srv.rooms))
+	for name := range srv.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		names[i] = name + " (" + strconv.Itoa(len(srv.rooms[name].members)) + ")"
+	}
+
+	return "Rooms: " + strings.Join(names, ", ")
+}
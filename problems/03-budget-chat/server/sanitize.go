@@ -0,0 +1,88 @@
+package server
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+// Length of the escape sequence at the start of `s`, which begins with ESC.
+func escapeLength(s string) int {
+	if len(s) < 2 {
+		return 1
+	}
+
+	switch s[1] {
+	case '[':
+		// CSI: parameter and intermediate bytes up to a final byte
+		for i := 2; i < len(s); i++ {
+			if s[i] >= 0x40 && s[i] <= 0x7e {
+				return i + 1
+			}
+		}
+		return len(s)
+	case ']', 'P', 'X', '^', '_':
+		// OSC, DCS and friends: a string terminated by BEL or ESC \
+		for i := 2; i < len(s); i++ {
+			if s[i] == '\a' {
+				return i + 1
+			}
+			if s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(s)
+	}
+
+	if s[1] < utf8.RuneSelf {
+		// Two character sequence
+		return 2
+	}
+	return 1
+}
+
+// Sanitize removes ANSI escape sequences and control characters from `text`,
+// so that users can't mess with each other's terminals. Tabs are turned into
+// spaces. Invalid UTF-8 is dropped as well.
+func Sanitize(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case r == '\x1b':
+			i += escapeLength(text[i:])
+			continue
+		case r == '\t':
+			b.WriteByte(' ')
+		case r == utf8.RuneError && size == 1:
+		case unicode.IsControl(r):
+		default:
+			b.WriteString(text[i : i+size])
+		}
+		i += size
+	}
+
+	return b.String()
+}
+
+// Reject messages that are not valid UTF-8 and clean up the rest before
+// they are relayed. Returns false if the message must be dropped.
+func (srv *Server) sanitize(msg *client.Message) bool {
+	if !utf8.ValidString(msg.Text) {
+		srv.notice(msg.Sender, "Messages must be valid UTF-8")
+		return false
+	}
+
+	text := Sanitize(msg.Text)
+	if text == "" && msg.Text != "" {
+		// Nothing but control characters
+		return false
+	}
+
+	msg.Text = text
+	return true
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		give string
+		want string
+	}{
+		{give: "hello", want: "hello"},
+		{give: "héllo wörld ☕", want: "héllo wörld ☕"},
+		{give: "a\tb", want: "a b"},
+		{give: "bell\a", want: "bell"},
+		{give: "\x1b[31mred\x1b[0m", want: "red"},
+		{give: "\x1b[2J\x1b[Hclear", want: "clear"},
+		{give: "\x1b]0;title\abody", want: "body"},
+		{give: "\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\", want: "link"},
+		{give: "\x1bcreset", want: "reset"},
+		{give: "trailing\x1b", want: "trailing"},
+		{give: "cut\x1b[12;", want: "cut"},
+		{give: "back\bspace\x7f", want: "backspace"},
+		{give: "c1\u009bcontrol", want: "c1control"},
+		{give: "bad\xffbyte", want: "badbyte"},
+	}
+
+	for _, test := range tests {
+		if have := Sanitize(test.give); have != test.want {
+			t.Errorf("%q: want %q have %q", test.give, test.want, have)
+		}
+	}
+}
+
+func TestSanitizeMessage(t *testing.T) {
+	srv, ln := serve(t)
+	alice := join(t, ln, "alice")
+	c := srv.findClient("alice")
+
+	tests := []struct {
+		give   string
+		want   string
+		passes bool
+	}{
+		{give: "\x1b[1mbold\x1b[0m", want: "bold", passes: true},
+		{give: "", want: "", passes: true},
+		{give: "\x1b[2J", passes: false},
+		{give: "bad\xff", passes: false},
+	}
+
+	for _, test := range tests {
+		msg := client.NewMessage(test.give, c)
+		if passes := srv.sanitize(msg); passes != test.passes {
+			t.Errorf("%q: want %v have %v", test.give, test.passes, passes)
+		} else if passes && msg.Text != test.want {
+			t.Errorf("%q: want %q have %q", test.give, test.want, msg.Text)
+		}
+	}
+
+	alice.expect("* Messages must be valid UTF-8")
+}
+
+func TestLineTooLong(t *testing.T) {
+	srv := NewServer()
+	srv.MaxLineLength = 16
+	_, ln := serveWith(t, srv)
+	alice := join(t, ln, "alice")
+
+	alice.send(strings.Repeat("x", 100))
+	alice.expect(strings.TrimSuffix(fmt.Sprintf(LineTooLongMessage, 16), "\n"))
+
+	// Still connected
+	alice.send("/rooms")
+	alice.expect("* Rooms: " + DefaultRoom + " (1)")
+}
@@ -0,0 +1,546 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// Listener handing out the server end of an in-memory pipe for every Dial.
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (ln *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *pipeListener) Close() error {
+	ln.closeOnce.Do(func() { close(ln.closed) })
+	return nil
+}
+
+func (ln *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (ln *pipeListener) Dial() (net.Conn, error) {
+	local, remote := net.Pipe()
+	select {
+	case ln.conns <- local:
+		return remote, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Start a server on an in-memory listener, shut down at the end of the test.
+func serve(t *testing.T) (*Server, *pipeListener) {
+	t.Helper()
+
+	return serveWith(t, NewServer())
+}
+
+// Like serve, for an already configured server.
+func serveWith(t *testing.T, srv *Server) (*Server, *pipeListener) {
+	t.Helper()
+
+	return serveHandler(t, srv, HandleClient)
+}
+
+// Like serveWith, attaching clients with `handler`.
+func serveHandler(t *testing.T, srv *Server, handler ClientHandler) (*Server, *pipeListener) {
+	t.Helper()
+
+	ln := newPipeListener()
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln, handler) }()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("want %v have %v", ErrServerClosed, err)
+		}
+	})
+
+	return srv, ln
+}
+
+// Connection of a user in a scenario, already past the welcome prompt.
+type user struct {
+	t     *testing.T
+	conn  net.Conn
+	lines *bufio.Reader
+}
+
+func dial(t *testing.T, ln *pipeListener) *user {
+	t.Helper()
+
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Runs before the server is shut down, so that it isn't left flushing
+	// to a pipe nobody reads
+	t.Cleanup(func() { conn.Close() })
+
+	u := &user{t: t, conn: conn, lines: bufio.NewReader(conn)}
+	u.expect(strings.TrimSuffix(UsernamePrompt, "\n"))
+	return u
+}
+
+// Dial and join as `username`, expecting to be let in.
+func join(t *testing.T, ln *pipeListener, username string) *user {
+	t.Helper()
+
+	u := dial(t, ln)
+	u.send(username)
+	if line := u.read(); !strings.HasPrefix(line, "* This room ") {
+		t.Fatalf("%s: want member list have %q", username, line)
+	}
+	return u
+}
+
+func (u *user) send(line string) {
+	u.t.Helper()
+
+	u.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := u.conn.Write([]byte(line + "\n")); err != nil {
+		u.t.Fatal(err)
+	}
+}
+
+func (u *user) read() string {
+	u.t.Helper()
+
+	u.conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := u.lines.ReadString('\n')
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func (u *user) expect(want string) {
+	u.t.Helper()
+
+	if line := u.read(); line != want {
+		u.t.Errorf("want %q have %q", want, line)
+	}
+}
+
+// Read lines until `want` shows up, skipping any others.
+func (u *user) readUntil(want string) {
+	u.t.Helper()
+
+	for {
+		if line := u.read(); line == want {
+			return
+		}
+	}
+}
+
+// Expect the server to hang up.
+func (u *user) expectClosed() {
+	u.t.Helper()
+
+	u.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := u.lines.ReadString('\n'); err != io.EOF {
+		u.t.Errorf("want EOF have %q %v", line, err)
+	}
+}
+
+// Expect nothing to arrive for a little while.
+func (u *user) expectSilence() {
+	u.t.Helper()
+
+	u.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	line, err := u.lines.ReadString('\n')
+	if err == nil {
+		u.t.Errorf("want nothing have %q", line)
+		return
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		u.t.Errorf("want timeout have %v", err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func hasClient(srv *Server, username string) func() bool {
+	return func() bool { return srv.findClient(username) != nil }
+}
+
+func TestScenarioJoin(t *testing.T) {
+	_, ln := serve(t)
+
+	alice := dial(t, ln)
+	alice.send("alice")
+	alice.expect("* This room is empty")
+
+	bob := dial(t, ln)
+	bob.send("bob")
+	bob.expect("* This room contains: alice")
+	alice.expect("* bob has entered the room")
+
+	carol := dial(t, ln)
+	carol.send("carol")
+	carol.expect("* This room contains: alice, bob")
+	alice.expect("* carol has entered the room")
+	bob.expect("* carol has entered the room")
+}
+
+func TestScenarioInvalidNames(t *testing.T) {
+	_, ln := serve(t)
+	join(t, ln, "alice")
+
+	tests := []struct {
+		give string
+		want string
+	}{
+		{give: "", want: InvalidUsernameMessage},
+		{give: "with space", want: InvalidUsernameMessage},
+		{give: "dash-ed", want: InvalidUsernameMessage},
+		{give: "ünicode", want: InvalidUsernameMessage},
+		{give: strings.Repeat("x", MaxUsernameLength+1), want: InvalidUsernameMessage},
+		{give: "alice", want: TakenUsernameMessage},
+		{give: "ALICE", want: TakenUsernameMessage},
+	}
+
+	for _, test := range tests {
+		u := dial(t, ln)
+		u.send(test.give)
+		u.expect(strings.TrimSuffix(test.want, "\n"))
+		u.expectClosed()
+	}
+
+	// The longest valid name is fine
+	join(t, ln, strings.Repeat("x", MaxUsernameLength))
+}
+
+func TestScenarioBroadcast(t *testing.T) {
+	_, ln := serve(t)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+	carol := join(t, ln, "carol")
+	alice.expect("* carol has entered the room")
+	bob.expect("* carol has entered the room")
+
+	alice.send("hello everyone")
+	bob.expect("[alice] hello everyone")
+	carol.expect("[alice] hello everyone")
+
+	bob.send("hi alice")
+	alice.expect("[bob] hi alice")
+	carol.expect("[bob] hi alice")
+
+	// Nobody gets their own messages back
+	alice.expectSilence()
+	bob.expectSilence()
+}
+
+func TestScenarioDeparture(t *testing.T) {
+	_, ln := serve(t)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+
+	bob.conn.Close()
+	alice.expect("* bob has left the room")
+
+	// Leaving before picking a name goes unnoticed
+	lurker := dial(t, ln)
+	lurker.conn.Close()
+	alice.expectSilence()
+
+	// The name is free again
+	join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+}
+
+func TestScenarioConcurrentJoins(t *testing.T) {
+	_, ln := serve(t)
+
+	const count = 50
+
+	var wg sync.WaitGroup
+	users := make([]*user, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			users[i] = dial(t, ln)
+			users[i].send(fmt.Sprintf("user%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	// Everyone got in, and saw only the users who had joined before them
+	for i, u := range users {
+		if line := u.read(); !strings.HasPrefix(line, "* This room ") {
+			t.Fatalf("user%d: want member list have %q", i, line)
+		}
+	}
+
+	observer := dial(t, ln)
+	observer.send("observer")
+	members, ok := strings.CutPrefix(observer.read(), "* This room contains: ")
+	if !ok {
+		t.Fatalf("want member list have %q", members)
+	}
+
+	names := strings.Split(members, ", ")
+	if len(names) != count {
+		t.Errorf("want %d users have %d: %v", count, len(names), names)
+	}
+	sort.Strings(names)
+	for i := 1; i < len(names); i++ {
+		if names[i] == names[i-1] {
+			t.Errorf("duplicate user %s", names[i])
+		}
+	}
+}
+
+func TestScenarioConcurrentSameName(t *testing.T) {
+	_, ln := serve(t)
+
+	const count = 20
+
+	replies := make(chan string, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			conn, err := ln.Dial()
+			if err != nil {
+				replies <- err.Error()
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+
+			conn.SetDeadline(time.Now().Add(time.Second))
+			lines := bufio.NewReader(conn)
+			lines.ReadString('\n') // Welcome prompt
+			conn.Write([]byte("alice\n"))
+			line, _ := lines.ReadString('\n')
+			replies <- line
+
+			// Keep draining so the winner's join notices don't pile up
+			io.Copy(io.Discard, lines)
+		}()
+	}
+
+	joined := 0
+	for i := 0; i < count; i++ {
+		switch line := <-replies; line {
+		case "* This room is empty\n":
+			joined++
+		case TakenUsernameMessage:
+		default:
+			t.Errorf("unexpected line %q", line)
+		}
+	}
+	if joined != 1 {
+		t.Errorf("want 1 join have %d", joined)
+	}
+}
+
+func TestScenarioRooms(t *testing.T) {
+	_, ln := serve(t)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+
+	// Joining a room that doesn't exist yet creates it
+	alice.send("/join games")
+	alice.expect("* This room is empty")
+	bob.expect("* alice has left the room")
+
+	bob.send("/rooms")
+	bob.expect("* Rooms: games (1), lobby (1)")
+
+	carol := join(t, ln, "carol")
+	bob.expect("* carol has entered the room")
+	alice.expectSilence()
+
+	carol.send("/join games")
+	carol.expect("* This room contains: alice")
+	alice.expect("* carol has entered the room")
+	bob.expect("* carol has left the room")
+
+	// Messages stay within their room
+	bob.send("anyone here?")
+	carol.send("ready?")
+	alice.expect("[carol] ready?")
+	alice.expectSilence()
+	bob.expectSilence()
+	carol.expectSilence()
+
+	// Parting goes back to the lobby
+	alice.send("/part")
+	alice.expect("* This room contains: bob")
+	carol.expect("* alice has left the room")
+	bob.expect("* alice has entered the room")
+
+	// Rooms go away once the last member leaves, except for the lobby
+	carol.send("/part")
+	carol.expect("* This room contains: bob, alice")
+	alice.expect("* carol has entered the room")
+	bob.expect("* carol has entered the room")
+
+	alice.send("/rooms")
+	alice.expect("* Rooms: lobby (3)")
+}
+
+func TestScenarioRoomErrors(t *testing.T) {
+	_, ln := serve(t)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+
+	tests := []struct {
+		give string
+		want string
+	}{
+		{give: "/part", want: "* You are not in a room you can leave"},
+		{give: "/join lobby", want: "* You are already in lobby"},
+		{give: "/join", want: "* Room names must only contain ASCII letters, digits, dashes or underscores"},
+		{give: "/join two words", want: "* Room names must only contain ASCII letters, digits, dashes or underscores"},
+		{give: "/join " + strings.Repeat("x", MaxRoomNameLength+1), want: "* Room names must only contain ASCII letters, digits, dashes or underscores"},
+	}
+
+	for _, test := range tests {
+		alice.send(test.give)
+		alice.expect(test.want)
+	}
+
+	alice.send("/join games")
+	alice.expect("* This room is empty")
+	bob.expect("* alice has left the room")
+
+	// Joining the same room again is a no-op
+	alice.send("/join games")
+	alice.expect("* You are already in games")
+	bob.expectSilence()
+
+	alice.send("/rooms")
+	alice.expect("* Rooms: games (1), lobby (1)")
+}
+
+func TestScenarioDirectMessages(t *testing.T) {
+	_, ln := serve(t)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+	carol := join(t, ln, "carol")
+	alice.expect("* carol has entered the room")
+	bob.expect("* carol has entered the room")
+
+	// Only the recipient sees a direct message
+	alice.send("/msg bob psst")
+	bob.expect("[alice -> bob] psst")
+
+	// Names are matched regardless of case
+	alice.send("/msg BOB again")
+	bob.expect("[alice -> bob] again")
+
+	alice.send("/msg alice note to self")
+	alice.expect("[alice -> alice] note to self")
+
+	alice.send("/msg dave hello")
+	alice.expect("* No such user: dave")
+
+	alice.send("/msg bob")
+	alice.expect("* Usage: /msg <user> <text>")
+
+	carol.expectSilence()
+	bob.expectSilence()
+}
+
+func TestScenarioMentions(t *testing.T) {
+	srv := NewServer()
+	srv.MarkMentions = true
+	_, ln := serveWith(t, srv)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+	carol := join(t, ln, "carol")
+	alice.expect("* carol has entered the room")
+	bob.expect("* carol has entered the room")
+
+	alice.send("hey @bob, look")
+	bob.expect("(mention) [alice] hey @bob, look")
+	carol.expect("[alice] hey @bob, look")
+
+	alice.send("@Carol! and @BOB")
+	bob.expect("(mention) [alice] @Carol! and @BOB")
+	carol.expect("(mention) [alice] @Carol! and @BOB")
+
+	// Mentioning yourself or nobody in particular changes nothing
+	bob.send("@bob @dave hi")
+	alice.expect("[bob] @bob @dave hi")
+	carol.expect("[bob] @bob @dave hi")
+
+	alice.expectSilence()
+	bob.expectSilence()
+}
+
+func TestScenarioMentionsUnmarked(t *testing.T) {
+	_, ln := serve(t)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+
+	// Plain clients get the usual lines unless marking is enabled
+	alice.send("hey @bob, look")
+	bob.expect("[alice] hey @bob, look")
+	bob.expectSilence()
+}
@@ -3,26 +3,147 @@ package server
 import (
 	"log"
 	"net"
-	"os"
 	"slices"
 	"strings"
 	"sync"
 
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/accounts"
 	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/transcript"
 )
 
 type Server struct {
 	clients    []*client.Client
 	clientLock sync.RWMutex
 
+	// Named rooms with at least one member, plus the default room
+	rooms map[string]*room
+
+	// Room each joined client is currently in
+	membership map[*client.Client]*room
+
+	startOnce sync.Once
+	startErr  error
+
+	// Everything Shutdown has to stop. `conns` counts attached clients and
+	// server links, `workers` the goroutines shared by all of them.
+	lifecycleLock sync.Mutex
+	closing       bool
+	quit          chan struct{}
+	listeners     map[net.Listener]bool
+	openLinks     map[*link]bool
+	bots          []*BotUser
+	conns         sync.WaitGroup
+	workers       sync.WaitGroup
+
+	// Messages sent by client handlers, screened before being relayed
+	inbox chan *client.Message
+
 	// Channel for relaying messages between clients
 	messageChan chan *client.Message
+
+	// Password hashing in progress, see PasswordWorkers. Results are handed
+	// back to the relay goroutine through `completions`, `hashing` is only
+	// used on it.
+	hashSlots   chan struct{}
+	completions chan func()
+	hashing     map[*client.Client]bool
+
+	moderation *moderation
+
+	// Links to other servers sharing the same rooms
+	federation *federation
+
+	// Recent messages of every room, replayed to clients entering it
+	history      map[string]*history
+	historyLock  sync.Mutex
+	historyDirty chan struct{}
+
+	// Rules for usernames picked by clients. Must be set before RunForever.
+	UsernamePolicy UsernamePolicy
+
+	// Registered usernames, which can only be used with their password.
+	// Registration is disabled if nil. Must be set before RunForever.
+	Accounts *accounts.Store
+
+	// Operator usernames and their passwords for /oper. Must be set
+	// before RunForever.
+	Operators map[string]string
+
+	// Messages per second a client may send, with bursts of up to
+	// RateBurst messages. Clients exceeding the limit are warned up to
+	// RateWarnings times within RateWarningExpiry of each other and then
+	// disconnected. A zero RateLimit disables flood control. Must be set
+	// before RunForever.
+	RateLimit    float64
+	RateBurst    int
+	RateWarnings int
+
+	// Number of outgoing messages a client may have pending before it is
+	// disconnected as a slow consumer, client.DefaultQueueSize if not
+	// positive. Must be set before RunForever.
+	QueueSize int
+
+	// Length of the longest line a client may send. Longer ones are
+	// rejected with a notice. Must be set before RunForever.
+	MaxLineLength int
+
+	// Number of messages per room replayed to clients entering it, and an
+	// optional file the history is kept in across restarts. Must be set
+	// before RunForever.
+	HistorySize int
+	HistoryFile string
+
+	// Whether room messages are marked with MentionPrefix for the users
+	// they mention. Off by default, as plain clients only expect the usual
+	// "[name] text" lines. Must be set before RunForever.
+	MarkMentions bool
+
+	// Optional transcript of joins, leaves and room messages. Must be set
+	// before RunForever.
+	Transcript *transcript.Writer
+
+	// Wrapped around the processing of every screened inbound message, the
+	// first one being outermost. Must be set before RunForever.
+	MessageMiddleware []MessageMiddleware
+
+	// Observers of joins, room messages and leaves. Must be set before
+	// RunForever.
+	Hooks []Hooks
+
+	// Name linked servers know this one by. Remote users whose username is
+	// taken here are shown as username@name. Defaults to a random id. Must
+	// be set before RunForever.
+	Name string
+
+	// Secret every linked server must share, links are refused without
+	// one. Must be set before RunForever.
+	LinkSecret string
 }
 
 func NewServer() *Server {
 	return &Server{
-		clients:     []*client.Client{},
-		messageChan: make(chan *client.Message),
+		clients:        []*client.Client{},
+		rooms:          map[string]*room{DefaultRoom: newRoom(DefaultRoom)},
+		membership:     map[*client.Client]*room{},
+		quit:           make(chan struct{}),
+		listeners:      map[net.Listener]bool{},
+		openLinks:      map[*link]bool{},
+		inbox:          make(chan *client.Message),
+		messageChan:    make(chan *client.Message),
+		hashSlots:      make(chan struct{}, PasswordWorkers),
+		completions:    make(chan func()),
+		hashing:        map[*client.Client]bool{},
+		moderation:     newModeration(),
+		federation:     newFederation(),
+		history:        map[string]*history{},
+		historyDirty:   make(chan struct{}, 1),
+		UsernamePolicy: DefaultUsernamePolicy{MaxLength: MaxUsernameLength},
+		Operators:      map[string]string{},
+		RateBurst:      5,
+		RateWarnings:   3,
+		QueueSize:      client.DefaultQueueSize,
+		MaxLineLength:  client.DefaultMaxLineLength,
 	}
 }
 
@@ -37,8 +158,12 @@ func (srv *Server) addClient(c *client.Client) {
 // Remove client from the list of currently connected ones
 // and inform others that the user has left.
 func (srv *Server) removeClient(c *client.Client) {
+	srv.leaveRoom(c)
+	srv.moderation.forget(c)
+
 	if c.Joined() {
-		defer srv.announceMembership(c, true /* leaving */)
+		srv.record(transcript.Quit, "", c.Username(), "")
+		srv.federate(c, linkEvent{Type: linkQuit, User: c.Username()})
 	}
 
 	srv.clientLock.Lock()
@@ -48,38 +173,30 @@ func (srv *Server) removeClient(c *client.Client) {
 	srv.clients = slices.Delete(srv.clients, idx, idx+1)
 }
 
-func (srv *Server) activeUsers() []*client.Client {
-	srv.clientLock.RLock()
-	defer srv.clientLock.RUnlock()
-
-	clients := []*client.Client{}
-	for _, c := range srv.clients {
-		if c.Joined() {
-			clients = append(clients, c)
-		}
+// Queue `data` for a single client, logging slow consumer evictions.
+func (srv *Server) send(c *client.Client, data []byte) {
+	if err := c.Write(data); err == client.ErrQueueFull {
+		log.Printf("Evicting %s: send queue full\n", c.RemoteAddr())
 	}
+}
 
-	return clients
+// Send a system message to a single client.
+func (srv *Server) notice(c *client.Client, text string) {
+	srv.send(c, []byte("* "+text+"\n"))
 }
 
-// Write `data` to all clients except the one passed in `exception`.
-func (srv *Server) writeToAllExcept(data []byte, exception *client.Client) {
-	for _, recepient := range srv.activeUsers() {
+// Write `data` to all members of `r` except the one passed in `exception`.
+func (srv *Server) writeToRoomExcept(r *room, data []byte, exception *client.Client) {
+	for _, recepient := range srv.roomMembers(r) {
 		if recepient == exception {
 			continue
 		}
 
-		go func(c *client.Client) {
-			if err := c.Write(data); err != nil {
-				if !os.IsTimeout(err) {
-					log.Printf("ERROR: Write error: %s\n", err)
-				}
-			}
-		}(recepient)
+		srv.send(recepient, data)
 	}
 }
 
-func (srv *Server) announceMembership(c *client.Client, leaving bool) {
+func (srv *Server) announceMembership(r *room, c *client.Client, leaving bool) {
 	verb := "entered"
 	if leaving {
 		verb = "left"
@@ -87,22 +204,23 @@ func (srv *Server) announceMembership(c *client.Client, leaving bool) {
 
 	var b strings.Builder
 	b.WriteString("* ")
-	b.WriteString(c.Username)
+	b.WriteString(c.Username())
 	b.WriteString(" has ")
 	b.WriteString(verb)
 	b.WriteString(" the room")
 
-	srv.writeToAllExcept(append([]byte(b.String()), '\n'), c)
+	srv.writeToRoomExcept(r, append([]byte(b.String()), '\n'), c)
 }
 
-// Send a list of active users to a newly connected client.
-func (srv *Server) listMembers(c *client.Client) {
+// Send a list of members of `r` to a newly joined client. Caller must hold
+// `srv.clientLock`.
+func (srv *Server) listMembersLocked(r *room, c *client.Client) {
 	names := []string{}
-	for _, user := range srv.activeUsers() {
+	for _, user := range r.members {
 		if user == c {
 			continue
 		}
-		names = append(names, user.Username)
+		names = append(names, user.Username())
 	}
 
 	var b strings.Builder
@@ -115,33 +233,112 @@ func (srv *Server) listMembers(c *client.Client) {
 		b.WriteString("is empty")
 	}
 
-	data := append([]byte(b.String()), '\n')
-	if err := c.Write(data); err != nil {
-		if !os.IsTimeout(err) {
-			log.Printf("ERROR: Write error: %s\n", err)
-		}
-	}
+	srv.send(c, append([]byte(b.String()), '\n'))
 }
 
 // Format message according to the protocol specification.
 func messageToString(msg *client.Message) string {
 	var b strings.Builder
 	b.WriteRune('[')
-	b.WriteString(msg.Sender.Username)
+	b.WriteString(msg.Sender.Username())
 	b.WriteString("] ")
 	b.WriteString(msg.Text)
 	return b.String()
 }
 
-// Read messages from `srv.messageChan` and relay to all joined clients.
+// Read messages from `srv.messageChan` and relay them to all members
+// of the sender's room, running any chat commands along the way. Messages
+// pass through MessageMiddleware first.
 func (srv *Server) relayMessages() {
-	for msg := range srv.messageChan {
-		data := append([]byte(messageToString(msg)), '\n')
-		srv.writeToAllExcept(data, msg.Sender)
+	defer srv.workers.Done()
+
+	handler := srv.messageHandler()
+	for {
+		select {
+		case msg, ok := <-srv.messageChan:
+			if !ok {
+				return
+			}
+			handler(msg)
+		case done := <-srv.completions:
+			done()
+		}
 	}
 }
 
-type ClientHandler func(*client.Client, chan<- *client.Message, func()) error
+// Handles a single connection. The handler joins the client to the chat by
+// calling `join` with the username they picked.
+type ClientHandler func(c *client.Client, messageChan chan<- *client.Message, join func(username string) error) error
+
+// Start the background goroutines shared by all connections. Safe to call
+// more than once.
+func (srv *Server) start() error {
+	srv.startOnce.Do(func() {
+		srv.lifecycleLock.Lock()
+		defer srv.lifecycleLock.Unlock()
+
+		if srv.closing {
+			srv.startErr = ErrServerClosed
+			return
+		}
+
+		if srv.HistoryFile != "" {
+			if err := srv.loadHistory(); err != nil {
+				srv.startErr = err
+				return
+			}
+			srv.workers.Add(1)
+			go srv.persistHistory()
+		}
+
+		srv.workers.Add(2)
+		go srv.screenMessages()
+		go srv.relayMessages()
+	})
+
+	return srv.startErr
+}
+
+// Serve a single, already established connection until it is closed. This
+// lets gateways speaking other transports plug their connections into the
+// same chat as TCP clients.
+func (srv *Server) Attach(conn net.Conn, handler ClientHandler) error {
+	if err := srv.start(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	if !srv.trackConn() {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer srv.conns.Done()
+
+	if srv.moderation.isAddrBanned(conn.RemoteAddr()) {
+		log.Printf("Rejecting banned address %s\n", conn.RemoteAddr())
+		conn.Write([]byte(BannedMessage))
+		return conn.Close()
+	}
+
+	c := client.NewClientWithQueue(conn, srv.QueueSize)
+	c.MaxLineLength = srv.MaxLineLength
+	srv.addClient(c)
+
+	defer c.Close()
+	defer srv.removeClient(c)
+
+	err := handler(c, srv.inbox, func(username string) error {
+		return srv.login(c, username)
+	})
+
+	if err != nil {
+		log.Printf("%s disconnected: %s\n", conn.RemoteAddr(), err)
+	} else {
+		log.Printf("%s disconnected\n", conn.RemoteAddr())
+	}
+
+	return err
+}
 
 // Run the chat server on the given 'address'.
 func (srv *Server) RunForever(address string, handler ClientHandler) error {
@@ -150,29 +347,34 @@ func (srv *Server) RunForever(address string, handler ClientHandler) error {
 		return err
 	}
 
-	go srv.relayMessages()
+	return srv.Serve(ln, handler)
+}
+
+// Serve accepts connections on `ln` and attaches them to the chat with
+// `handler`. Any listener works, so tests may serve over in-memory pipes.
+// `ln` is closed when Serve returns.
+func (srv *Server) Serve(ln net.Listener, handler ClientHandler) error {
+	defer ln.Close()
+
+	if err := srv.start(); err != nil {
+		return err
+	}
+
+	if !srv.trackListener(ln) {
+		return ErrServerClosed
+	}
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if srv.isClosing() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
-		log.Printf("New TCP connection: %s\n", conn.RemoteAddr())
-
-		c := client.NewClient(conn)
-		srv.addClient(c)
-
-		go func(c *client.Client) {
-			defer conn.Close()
-			defer srv.removeClient(c)
-
-			handler(c, srv.messageChan, func() {
-				srv.listMembers(c)
-				srv.announceMembership(c, false)
-			})
+		log.Printf("New connection: %s\n", conn.RemoteAddr())
 
-			log.Printf("%s disconnected\n", conn.RemoteAddr())
-		}(c)
+		go srv.Attach(conn, handler)
 	}
 }
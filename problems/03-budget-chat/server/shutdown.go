@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+)
+
+// Sent to every client when the server shuts down.
+const ShutdownMessage = "* server is shutting down\n"
+
+// Returned by RunForever, Serve, ServeLinks, Link and Attach once the server
+// is shutting down.
+var ErrServerClosed = errors.New("server closed")
+
+func (srv *Server) isClosing() bool {
+	srv.lifecycleLock.Lock()
+	defer srv.lifecycleLock.Unlock()
+
+	return srv.closing
+}
+
+// Register a listener to be closed on shutdown.
+func (srv *Server) trackListener(ln net.Listener) bool {
+	srv.lifecycleLock.Lock()
+	defer srv.lifecycleLock.Unlock()
+
+	if srv.closing {
+		return false
+	}
+	srv.listeners[ln] = true
+	return true
+}
+
+// Register a connection Shutdown waits for. Must be paired with
+// srv.conns.Done() if successful.
+func (srv *Server) trackConn() bool {
+	srv.lifecycleLock.Lock()
+	defer srv.lifecycleLock.Unlock()
+
+	if srv.closing {
+		return false
+	}
+	srv.conns.Add(1)
+	return true
+}
+
+// Register a server link to be closed on shutdown.
+func (srv *Server) trackLink(l *link) bool {
+	srv.lifecycleLock.Lock()
+	defer srv.lifecycleLock.Unlock()
+
+	if srv.closing {
+		return false
+	}
+	srv.openLinks[l] = true
+	srv.conns.Add(1)
+	return true
+}
+
+func (srv *Server) untrackLink(l *link) {
+	srv.lifecycleLock.Lock()
+	delete(srv.openLinks, l)
+	srv.lifecycleLock.Unlock()
+
+	srv.conns.Done()
+}
+
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting connections and links, tells every client the
+// server is going away, delivers their pending messages and disconnects
+// them. It waits for all goroutines of the server to exit, or returns the
+// context's error if that takes too long. The server can't be used again
+// afterwards.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.lifecycleLock.Lock()
+	if srv.closing {
+		srv.lifecycleLock.Unlock()
+		return ErrServerClosed
+	}
+	srv.closing = true
+	close(srv.quit)
+
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+	links := make([]*link, 0, len(srv.openLinks))
+	for l := range srv.openLinks {
+		links = append(links, l)
+	}
+	bots := srv.bots
+	srv.lifecycleLock.Unlock()
+
+	for _, l := range links {
+		l.close()
+	}
+
+	for _, u := range bots {
+		u.Quit()
+	}
+
+	srv.clientLock.RLock()
+	clients := slices.Clone(srv.clients)
+	srv.clientLock.RUnlock()
+
+	// Closing a client flushes its queue first, so don't let a slow one
+	// hold up the others
+	for _, c := range clients {
+		srv.send(c, []byte(ShutdownMessage))
+		go c.Close()
+	}
+
+	if err := waitContext(ctx, &srv.conns); err != nil {
+		return err
+	}
+
+	// No handler is left to send messages, let the pipeline drain
+	close(srv.inbox)
+	if err := waitContext(ctx, &srv.workers); err != nil {
+		return err
+	}
+
+	if srv.HistoryFile != "" {
+		return srv.saveHistory()
+	}
+	return nil
+}
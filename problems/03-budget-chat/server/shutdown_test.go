@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	srv := newNamedServer("a")
+	srv.HistorySize = 10
+	srv.HistoryFile = filepath.Join(t.TempDir(), "history.json")
+	if _, err := srv.AddBot("helper", make(recordingBot, BotQueueSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	running := make(chan error, 2)
+	clients := newPipeListener()
+	go func() { running <- srv.Serve(clients, HandleClient) }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { running <- srv.ServeLinks(ln) }()
+
+	peer := newNamedServer("b")
+	if _, err := peer.AddBot("bob", make(recordingBot, BotQueueSize)); err != nil {
+		t.Fatal(err)
+	}
+	linked := make(chan struct{})
+	go func() {
+		peer.LinkForever(ln.Addr().String(), time.Millisecond)
+		close(linked)
+	}()
+	waitFor(t, hasClient(srv, "bob"))
+
+	alice := join(t, clients, "alice")
+	carol := join(t, clients, "carol")
+	alice.expect("* carol has entered the room")
+
+	alice.send("hello")
+	carol.expect("[alice] hello")
+
+	// Read everything up to the disconnect while the server flushes
+	told := make(chan error, 2)
+	for _, u := range []*user{alice, carol} {
+		u.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		go func(lines *bufio.Reader) {
+			seen := false
+			for {
+				line, err := lines.ReadString('\n')
+				if err == io.EOF && seen {
+					told <- nil
+					return
+				}
+				if err != nil {
+					told <- err
+					return
+				}
+				seen = seen || line == ShutdownMessage
+			}
+		}(u.lines)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Shutdown(ctx); err != ErrServerClosed {
+		t.Errorf("want %v have %v", ErrServerClosed, err)
+	}
+
+	// Everyone is told, then disconnected
+	for i := 0; i < 2; i++ {
+		if err := <-told; err != nil {
+			t.Errorf("want %q and EOF: %s", ShutdownMessage, err)
+		}
+	}
+	alice.conn.Close()
+	carol.conn.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := <-running; err != ErrServerClosed {
+			t.Errorf("want %v have %v", ErrServerClosed, err)
+		}
+	}
+
+	if err := srv.Attach(&net.TCPConn{}, HandleClient); err != ErrServerClosed {
+		t.Errorf("want %v have %v", ErrServerClosed, err)
+	}
+
+	if err := peer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-linked
+
+	if data, err := os.ReadFile(srv.HistoryFile); err != nil || !strings.Contains(string(data), "[alice] hello") {
+		t.Errorf("history not saved: %q %v", data, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			var b strings.Builder
+			pprof.Lookup("goroutine").WriteTo(&b, 1)
+			t.Fatalf("want %d goroutines have %d:\n%s", before, runtime.NumGoroutine(), b.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"log"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/transcript"
+)
+
+// Append an event to the transcript, if one is kept.
+func (srv *Server) record(typ transcript.EventType, room, user, text string) {
+	if srv.Transcript == nil {
+		return
+	}
+
+	ev := transcript.Event{Type: typ, Room: room, User: user, Text: text}
+	if err := srv.Transcript.Write(ev); err != nil {
+		log.Printf("ERROR: Failed to write transcript: %s\n", err)
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/transcript"
+)
+
+func TestTranscript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.jsonl")
+
+	w, err := transcript.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closed once the server is shut down
+	t.Cleanup(func() { w.Close() })
+
+	srv := NewServer()
+	srv.Transcript = w
+	_, ln := serveWith(t, srv)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+
+	alice.send("hello")
+	bob.expect("[alice] hello")
+	alice.send("/msg bob secret")
+	bob.expect("[alice -> bob] secret")
+	bob.send("/join dev")
+	bob.expect("* This room is empty")
+	bob.send("/nick robert")
+	bob.expect("* You are now known as robert")
+	bob.conn.Close()
+	waitFor(t, func() bool { return !hasClient(srv, "robert")() })
+
+	want := []transcript.Event{
+		{Type: transcript.Join, Room: DefaultRoom, User: "alice"},
+		{Type: transcript.Join, Room: DefaultRoom, User: "bob"},
+		{Type: transcript.Message, Room: DefaultRoom, User: "alice", Text: "hello"},
+		{Type: transcript.Leave, Room: DefaultRoom, User: "bob"},
+		{Type: transcript.Join, Room: "dev", User: "bob"},
+		{Type: transcript.Rename, User: "bob", Text: "robert"},
+		{Type: transcript.Leave, Room: "dev", User: "robert"},
+		{Type: transcript.Quit, User: "robert"},
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r := transcript.NewReader(f)
+	for _, ev := range want {
+		have, err := r.Read()
+		if err != nil {
+			t.Fatalf("want %+v: %s", ev, err)
+		}
+		if have.Time.IsZero() {
+			t.Errorf("missing timestamp on %+v", have)
+		}
+		have.Time = ev.Time
+		if have != ev {
+			t.Errorf("want %+v have %+v", ev, have)
+		}
+	}
+
+	if ev, err := r.Read(); err != io.EOF {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/client"
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/transcript"
+)
+
+const MaxUsernameLength = 16
+
+var (
+	ErrInvalidUsername  = errors.New("invalid username")
+	ErrUsernameReserved = errors.New("username is reserved")
+	ErrUsernameTaken    = errors.New("username is already taken")
+)
+
+// UsernamePolicy decides which usernames clients may pick. Uniqueness among
+// joined users is always enforced by the server on top of the policy.
+type UsernamePolicy interface {
+	Validate(username string) error
+}
+
+// Usernames of 1 to MaxLength ASCII letters, digits or underscores that
+// don't match any of the Reserved names, ignoring case.
+type DefaultUsernamePolicy struct {
+	MaxLength int
+	Reserved  []string
+}
+
+func isUsernameByte(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '_'
+}
+
+func (p DefaultUsernamePolicy) Validate(username string) error {
+	if len(username) == 0 || len(username) > p.MaxLength {
+		return ErrInvalidUsername
+	}
+
+	for _, b := range []byte(username) {
+		if !isUsernameByte(b) {
+			return ErrInvalidUsername
+		}
+	}
+
+	for _, reserved := range p.Reserved {
+		if strings.EqualFold(username, reserved) {
+			return ErrUsernameReserved
+		}
+	}
+
+	return nil
+}
+
+// Check whether `username` is free to be used by `c`. Caller must hold
+// `srv.clientLock`.
+func (srv *Server) checkUsernameLocked(c *client.Client, username string) error {
+	if err := srv.UsernamePolicy.Validate(username); err != nil {
+		return err
+	}
+
+	if srv.moderation.isNameBanned(username) {
+		return ErrUsernameBanned
+	}
+
+	for _, other := range srv.clients {
+		if other != c && other.Joined() && strings.EqualFold(other.Username(), username) {
+			return ErrUsernameTaken
+		}
+	}
+
+	return nil
+}
+
+// Join client to the chat under `username` and place them in the default room.
+func (srv *Server) join(c *client.Client, username string) error {
+	srv.clientLock.Lock()
+	if err := srv.checkUsernameLocked(c, username); err != nil {
+		srv.clientLock.Unlock()
+		return err
+	}
+	c.SetUsername(username)
+	srv.clientLock.Unlock()
+
+	c.MarkJoined()
+	srv.enterRoom(c, DefaultRoom)
+	return nil
+}
+
+// Change the username of an already joined client and tell their room.
+func (srv *Server) rename(c *client.Client, username string) error {
+	srv.clientLock.Lock()
+	if err := srv.checkUsernameLocked(c, username); err != nil {
+		srv.clientLock.Unlock()
+		return err
+	}
+	previous := c.Username()
+	c.SetUsername(username)
+	r := srv.membership[c]
+	srv.clientLock.Unlock()
+
+	srv.renamed(c, previous, r)
+	return nil
+}
+
+// Tell the room `r` that the client formerly known as `previous` has
+// changed their username.
+func (srv *Server) renamed(c *client.Client, previous string, r *room) {
+	username := c.Username()
+	srv.record(transcript.Rename, "", previous, username)
+	srv.federate(c, linkEvent{Type: linkRename, User: previous, Text: username})
+
+	if r != nil {
+		srv.writeToRoomExcept(r, []byte("* "+previous+" is now known as "+username+"\n"), c)
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDefaultUsernamePolicy(t *testing.T) {
+	policy := DefaultUsernamePolicy{MaxLength: MaxUsernameLength, Reserved: []string{"admin"}}
+
+	tests := []struct {
+		give string
+		want error
+	}{
+		{give: "alice", want: nil},
+		{give: "Bob_42", want: nil},
+		{give: "_", want: nil},
+		{give: "abcdefghijklmnop", want: nil},
+		{give: "abcdefghijklmnopq", want: ErrInvalidUsername},
+		{give: "", want: ErrInvalidUsername},
+		{give: "with space", want: ErrInvalidUsername},
+		{give: "a[b", want: ErrInvalidUsername},
+		{give: "a\\b", want: ErrInvalidUsername},
+		{give: "a]b", want: ErrInvalidUsername},
+		{give: "a^b", want: ErrInvalidUsername},
+		{give: "a`b", want: ErrInvalidUsername},
+		{give: "café", want: ErrInvalidUsername},
+		{give: "admin", want: ErrUsernameReserved},
+		{give: "AdMiN", want: ErrUsernameReserved},
+		{give: "admin2", want: nil},
+	}
+
+	for _, test := range tests {
+		if err := policy.Validate(test.give); err != test.want {
+			t.Errorf("%q: want %v have %v", test.give, test.want, err)
+		}
+	}
+}
+
+func TestJoinUniqueness(t *testing.T) {
+	_, ln := serve(t)
+	join(t, ln, "alice")
+
+	tests := []struct {
+		give string
+		want string
+	}{
+		{give: "alice", want: strings.TrimSuffix(TakenUsernameMessage, "\n")},
+		{give: "ALICE", want: strings.TrimSuffix(TakenUsernameMessage, "\n")},
+		{give: "bob", want: "* This room contains: alice"},
+	}
+
+	for _, test := range tests {
+		u := dial(t, ln)
+		u.send(test.give)
+		u.expect(test.want)
+	}
+}
+
+func TestNickCommand(t *testing.T) {
+	_, ln := serve(t)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+
+	tests := []struct {
+		give      string
+		wantSelf  string
+		wantOther string
+	}{
+		{give: "/nick alice", wantSelf: "* Username alice is already taken"},
+		{give: "/nick a^b", wantSelf: "* Usernames must only contain ASCII letters, digits or underscores"},
+		{give: "/nick robert", wantSelf: "* You are now known as robert", wantOther: "* bob is now known as robert"},
+		{give: "/nick Robert", wantSelf: "* You are now known as Robert", wantOther: "* robert is now known as Robert"},
+	}
+
+	for _, test := range tests {
+		bob.send(test.give)
+		bob.expect(test.wantSelf)
+		if test.wantOther != "" {
+			alice.expect(test.wantOther)
+		}
+	}
+	alice.expectSilence()
+}
+
+// Meant to be run with -race: renames happen on the relay goroutine while
+// screening and joins read the name elsewhere.
+func TestRenameWhileChatting(t *testing.T) {
+	srv, ln := serve(t)
+
+	alice := join(t, ln, "alice")
+	bob := join(t, ln, "bob")
+	alice.expect("* bob has entered the room")
+
+	// Neither keeps up with the flood of notices, drain them in the background
+	go io.Copy(io.Discard, alice.lines)
+	go io.Copy(io.Discard, bob.lines)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		// Newcomers are told who's in the room, bob included
+		for i := 0; i < 20; i++ {
+			conn, err := ln.Dial()
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(time.Second))
+			lines := bufio.NewReader(conn)
+			lines.ReadString('\n') // Welcome prompt
+			fmt.Fprintf(conn, "guest%d\n", i)
+			lines.ReadString('\n') // Member list
+			conn.Close()
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		bob.send(fmt.Sprintf("/nick bob%d", i))
+		bob.send(fmt.Sprintf("hello @alice from bob%d", i))
+	}
+	wg.Wait()
+
+	waitFor(t, hasClient(srv, "bob49"))
+}
@@ -0,0 +1,187 @@
+// Package transcript records what happens in budget-chat rooms.
+//
+// A transcript is an append-only file with one JSON encoded Event per line.
+// Writer rotates the file once it grows past a size limit or gets too old,
+// keeping rotated files next to it with a timestamp suffix.
+package transcript
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	// User entered a room, either after picking a username or with /join
+	Join EventType = "join"
+
+	// User left a room, either for another one or because they quit
+	Leave EventType = "leave"
+
+	// User sent a message to their room
+	Message EventType = "message"
+
+	// User changed their username, Text holds the new one
+	Rename EventType = "rename"
+
+	// User disconnected
+	Quit EventType = "quit"
+)
+
+type Event struct {
+	Time time.Time `json:"time"`
+	Type EventType `json:"type"`
+	Room string    `json:"room,omitempty"`
+	User string    `json:"user"`
+	Text string    `json:"text,omitempty"`
+}
+
+// Layout of the suffix appended to the names of rotated files.
+const RotatedSuffix = "20060102T150405.000000000"
+
+// Writer appends events to a transcript file, rotating it as configured.
+type Writer struct {
+	path string
+
+	// Rotate once the file reaches MaxSize bytes or was opened MaxAge ago.
+	// Zero disables the respective limit. Must be set before the first
+	// Write.
+	MaxSize int64
+	MaxAge  time.Duration
+
+	// Clock used for event timestamps and rotation, time.Now by default.
+	Now func() time.Time
+
+	lock   sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// Open the transcript at `path` for appending, creating it if needed.
+func Open(path string) (*Writer, error) {
+	w := &Writer{
+		path: path,
+		Now:  time.Now,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.f = f
+	w.size = info.Size()
+	w.opened = w.Now()
+	return nil
+}
+
+// Move the current file aside and start a new one.
+func (w *Writer) rotate(now time.Time) error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(w.path, w.path+"."+now.UTC().Format(RotatedSuffix)); err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+func (w *Writer) shouldRotate(now time.Time, n int) bool {
+	if w.size == 0 {
+		return false
+	}
+
+	if w.MaxSize > 0 && w.size+int64(n) > w.MaxSize {
+		return true
+	}
+
+	return w.MaxAge > 0 && now.Sub(w.opened) >= w.MaxAge
+}
+
+// Write appends `ev` to the transcript, stamping it with the current time
+// if it has none.
+func (w *Writer) Write(ev Event) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	now := w.Now()
+	if ev.Time.IsZero() {
+		ev.Time = now
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if w.shouldRotate(now, len(data)) {
+		if err := w.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.f.Write(data)
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.f.Close()
+}
+
+// Reader decodes events from a transcript.
+type Reader struct {
+	scanner *bufio.Scanner
+}
+
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	return &Reader{scanner: scanner}
+}
+
+// Read the next event, returning io.EOF at the end of the transcript.
+// Blank lines are skipped.
+func (r *Reader) Read() (Event, error) {
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var ev Event
+		err := json.Unmarshal(line, &ev)
+		return ev, err
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
@@ -0,0 +1,142 @@
+package transcript
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAll(t *testing.T, path string) []Event {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	events := []Event{}
+	r := NewReader(f)
+	for {
+		ev, err := r.Read()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.jsonl")
+
+	w, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	w.Now = func() time.Time { return now }
+
+	want := []Event{
+		{Type: Join, Room: "lobby", User: "alice"},
+		{Type: Message, Room: "lobby", User: "alice", Text: "hello \"world\""},
+		{Type: Rename, User: "alice", Text: "alison"},
+		{Type: Leave, Room: "lobby", User: "alison"},
+		{Type: Quit, User: "alison"},
+	}
+	for _, ev := range want {
+		if err := w.Write(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	have := readAll(t, path)
+	if len(have) != len(want) {
+		t.Fatalf("want %d events have %d", len(want), len(have))
+	}
+	for i := range want {
+		want[i].Time = now
+		if !have[i].Time.Equal(now) {
+			t.Errorf("want time %v have %v", now, have[i].Time)
+		}
+		have[i].Time = now
+		if have[i] != want[i] {
+			t.Errorf("want %+v have %+v", want[i], have[i])
+		}
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	r := NewReader(strings.NewReader("\n{\"type\":\"join\",\"user\":\"bob\"}\nnot json\n"))
+
+	if ev, err := r.Read(); err != nil || ev.User != "bob" {
+		t.Fatalf("want bob have %+v %v", ev, err)
+	}
+	if _, err := r.Read(); err == nil {
+		t.Error("want error for malformed line")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	tests := []struct {
+		maxSize   int64
+		maxAge    time.Duration
+		step      time.Duration
+		events    int
+		wantFiles int
+	}{
+		{events: 10, wantFiles: 1},
+		{maxSize: 1, events: 3, wantFiles: 3},
+		{maxSize: 200, events: 10, wantFiles: 5},
+		{maxAge: time.Minute, step: 30 * time.Second, events: 6, wantFiles: 4},
+		{maxAge: time.Hour, step: 30 * time.Second, events: 6, wantFiles: 1},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "transcript.jsonl")
+
+		now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		w, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.MaxSize = test.maxSize
+		w.MaxAge = test.maxAge
+		w.Now = func() time.Time { return now }
+		w.opened = now
+
+		for i := 0; i < test.events; i++ {
+			// Distinct timestamps keep the names of rotated files unique
+			now = now.Add(test.step + time.Millisecond)
+			if err := w.Write(Event{Type: Message, Room: "lobby", User: "alice", Text: "hello"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Close()
+
+		files, err := filepath.Glob(path + "*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != test.wantFiles {
+			t.Errorf("want %d files have %d", test.wantFiles, len(files))
+		}
+
+		total := 0
+		for _, file := range files {
+			total += len(readAll(t, file))
+		}
+		if total != test.events {
+			t.Errorf("want %d events have %d", test.events, total)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+// Package websocket lets browsers join budget-chat over WebSocket (RFC 6455).
+//
+// Every text message a browser sends is treated as one chat line, and every
+// line the server writes is sent back as one text message, so WebSocket users
+// share rooms and system messages with TCP users.
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/server"
+)
+
+// GUID every server appends to Sec-WebSocket-Key, as defined by RFC 6455.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Largest message accepted from a browser.
+const MaxMessageSize = 64 * 1024
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Close status codes
+const (
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	closeTooBig        = 1009
+)
+
+var (
+	ErrProtocol        = errors.New("websocket: protocol error")
+	ErrMessageTooLarge = errors.New("websocket: message too large")
+)
+
+// Value of the Sec-WebSocket-Accept header for a given Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handler upgrades requests to WebSocket connections and attaches them to `srv`.
+func Handler(srv *server.Server, handler server.ClientHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet ||
+			!headerContains(r.Header, "Connection", "upgrade") ||
+			!headerContains(r.Header, "Upgrade", "websocket") {
+			http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+			return
+		}
+
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+			return
+		}
+
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if key == "" {
+			http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+			return
+		}
+
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "connection can't be upgraded", http.StatusInternalServerError)
+			return
+		}
+
+		netConn, brw, err := hijacker.Hijack()
+		if err != nil {
+			log.Printf("ERROR: WebSocket hijack failed: %s\n", err)
+			return
+		}
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		brw.WriteString("Upgrade: websocket\r\n")
+		brw.WriteString("Connection: Upgrade\r\n")
+		brw.WriteString("Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n")
+		if err := brw.Flush(); err != nil {
+			netConn.Close()
+			return
+		}
+
+		log.Printf("New WebSocket connection: %s\n", netConn.RemoteAddr())
+
+		srv.Attach(newConn(netConn, brw.Reader), handler)
+	})
+}
+
+// Conn adapts a server side WebSocket connection to the newline delimited
+// stream budget-chat expects.
+type Conn struct {
+	net.Conn
+
+	r *bufio.Reader
+
+	// Data of received messages not yet consumed by Read
+	pending []byte
+
+	// Partial line written without a trailing newline yet
+	partial []byte
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+func newConn(conn net.Conn, r *bufio.Reader) *Conn {
+	return &Conn{
+		Conn: conn,
+		r:    r,
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		msg = bytes.TrimSuffix(msg, []byte("\n"))
+		c.pending = append(msg, '\n')
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Read the next data message, answering control frames along the way.
+func (c *Conn) readMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+
+	for {
+		fin, opcode, payload, err := readFrame(c.r, MaxMessageSize-len(msg))
+		if err != nil {
+			switch err {
+			case ErrMessageTooLarge:
+				c.closeWith(closeTooBig)
+			case ErrProtocol:
+				c.closeWith(closeProtocolError)
+			}
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.closeWith(closeNormal)
+			return nil, io.EOF
+		case opText, opBinary:
+			if started {
+				c.closeWith(closeProtocolError)
+				return nil, ErrProtocol
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				c.closeWith(closeProtocolError)
+				return nil, ErrProtocol
+			}
+		default:
+			c.closeWith(closeProtocolError)
+			return nil, ErrProtocol
+		}
+
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// Send every complete line in `p` as its own text message.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.partial = append(c.partial, p...)
+
+	for {
+		idx := bytes.IndexByte(c.partial, '\n')
+		if idx < 0 {
+			break
+		}
+
+		if err := c.writeFrame(opText, c.partial[:idx]); err != nil {
+			return 0, err
+		}
+		c.partial = c.partial[idx+1:]
+	}
+
+	return len(p), nil
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.Conn.Write(appendFrame(nil, opcode, payload, nil))
+	return err
+}
+
+// Send a close frame with `code` and close the connection.
+func (c *Conn) closeWith(code uint16) {
+	c.closeOnce.Do(func() {
+		payload := binary.BigEndian.AppendUint16(nil, code)
+		c.writeFrame(opClose, payload)
+		c.Conn.Close()
+	})
+}
+
+func (c *Conn) Close() error {
+	c.closeWith(closeNormal)
+	return nil
+}
+
+// Read a single frame. Frames sent by clients must be masked.
+func readFrame(r *bufio.Reader, limit int) (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	if header[0]&0x70 != 0 || !masked {
+		// Reserved bits set or unmasked client frame
+		return false, 0, nil, ErrProtocol
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= opClose && (!fin || length > 125) {
+		// Control frames must not be fragmented or long
+		return false, 0, nil, ErrProtocol
+	}
+
+	if length > uint64(limit) {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// Append a final frame to `b`, masking the payload if `mask` is not nil.
+func appendFrame(b []byte, opcode byte, payload []byte, mask []byte) []byte {
+	b = append(b, 0x80|opcode)
+
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+
+	switch n := len(payload); {
+	case n <= 125:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xffff:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+
+	if mask == nil {
+		return append(b, payload...)
+	}
+
+	b = append(b, mask...)
+	for i, v := range payload {
+		b = append(b, v^mask[i%4])
+	}
+	return b
+}
@@ -0,0 +1,212 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/waterfountain1996/protohackers/problems/03-budget-chat/server"
+)
+
+// In-process WebSocket client.
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, url string) *wsClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	req := "GET / HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("want status %d have %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %q", accept)
+	}
+
+	return &wsClient{conn: conn, r: r}
+}
+
+func (ws *wsClient) send(t *testing.T, opcode byte, payload string) {
+	t.Helper()
+
+	frame := appendFrame(nil, opcode, []byte(payload), []byte{0x12, 0x34, 0x56, 0x78})
+	if _, err := ws.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Read the next frame sent by the server.
+func (ws *wsClient) recv(t *testing.T) (byte, string) {
+	t.Helper()
+
+	ws.conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var header [2]byte
+	if _, err := io.ReadFull(ws.r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if header[1]&0x80 != 0 {
+		t.Fatal("server frames must not be masked")
+	}
+
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	return header[0] & 0x0f, string(payload)
+}
+
+func (ws *wsClient) expect(t *testing.T, want string) {
+	t.Helper()
+
+	if opcode, text := ws.recv(t); opcode != opText || text != want {
+		t.Fatalf("want text %q have opcode %d %q", want, opcode, text)
+	}
+}
+
+// TCP-like client attached through an in-memory pipe.
+func attachPipe(t *testing.T, srv *server.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	go srv.Attach(local, server.HandleClient)
+
+	return remote, bufio.NewReader(remote)
+}
+
+func readLine(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455, section 1.3
+	if key := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected key %q", key)
+	}
+}
+
+func TestRejectsPlainHTTP(t *testing.T) {
+	ts := httptest.NewServer(Handler(server.NewServer(), server.HandleClient))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("want status %d have %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestSharedRoom(t *testing.T) {
+	srv := server.NewServer()
+	ts := httptest.NewServer(Handler(srv, server.HandleClient))
+	defer ts.Close()
+
+	tcp, tcpLines := attachPipe(t, srv)
+	readLine(t, tcpLines) // Welcome prompt
+	tcp.Write([]byte("alice\n"))
+	if line := readLine(t, tcpLines); line != "* This room is empty" {
+		t.Fatalf("unexpected line %q", line)
+	}
+
+	ws := dial(t, ts.URL)
+	ws.expect(t, "Welcome to budgetchat! What shall I call you?")
+	ws.send(t, opText, "bob")
+	ws.expect(t, "* This room contains: alice")
+
+	if line := readLine(t, tcpLines); line != "* bob has entered the room" {
+		t.Fatalf("unexpected line %q", line)
+	}
+
+	// Fragmented message with a ping in between
+	ws.conn.Write(append(
+		[]byte{0x01, 0x80 | 3, 0, 0, 0, 0, 'h', 'e', 'l'},
+		0x89, 0x80, 0, 0, 0, 0,
+	))
+	if opcode, _ := ws.recv(t); opcode != opPong {
+		t.Fatalf("want pong have opcode %d", opcode)
+	}
+	ws.conn.Write([]byte{0x80, 0x80 | 2, 0, 0, 0, 0, 'l', 'o'})
+
+	if line := readLine(t, tcpLines); line != "[bob] hello" {
+		t.Fatalf("unexpected line %q", line)
+	}
+
+	tcp.Write([]byte("hi bob\n"))
+	ws.expect(t, "[alice] hi bob")
+
+	ws.send(t, opClose, "")
+	if opcode, _ := ws.recv(t); opcode != opClose {
+		t.Fatalf("want close have opcode %d", opcode)
+	}
+
+	if line := readLine(t, tcpLines); line != "* bob has left the room" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestUnmaskedFrame(t *testing.T) {
+	srv := server.NewServer()
+	ts := httptest.NewServer(Handler(srv, server.HandleClient))
+	defer ts.Close()
+
+	ws := dial(t, ts.URL)
+	ws.expect(t, "Welcome to budgetchat! What shall I call you?")
+
+	ws.conn.Write(appendFrame(nil, opText, []byte("bob"), nil))
+
+	opcode, payload := ws.recv(t)
+	if opcode != opClose || binary.BigEndian.Uint16([]byte(payload)) != closeProtocolError {
+		t.Fatalf("want protocol error close have opcode %d %v", opcode, []byte(payload))
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// Contents of a DB.
+type state struct {
+	items map[string]string
+
+	// Deadlines of the items that expire
+	expires map[string]time.Time
+}
+
+func newState() *state {
+	return &state{
+		items:   make(map[string]string),
+		expires: make(map[string]time.Time),
+	}
+}
+
+// Set `key` to `value`, expiring at `expires` unless it is zero.
+func (s *state) set(key, value string, expires time.Time) {
+	s.items[key] = value
+	if expires.IsZero() {
+		delete(s.expires, key)
+	} else {
+		s.expires[key] = expires
+	}
+}
+
+func (s *state) apply(rec record) error {
+	switch rec.op {
+	case opSet:
+		s.set(rec.key, rec.value, time.Time{})
+	case opSetExpiring:
+		s.set(rec.key, rec.value, time.Unix(0, rec.expires))
+	default:
+		return ErrCorruptRecord
+	}
+	return nil
+}
+
+// Record of setting `key` to `value` until `expires`, or for good if it is
+// zero.
+func setRecord(key, value string, expires time.Time) record {
+	if expires.IsZero() {
+		return record{op: opSet, key: key, value: value}
+	}
+	return record{op: opSetExpiring, key: key, value: value, expires: expires.UnixNano()}
+}
+
+// Record that recreates `key` with `value`.
+func (s *state) record(key, value string) record {
+	return setRecord(key, value, s.expires[key])
+}
+
+func (s *state) expired(key string, now time.Time) bool {
+	expires, ok := s.expires[key]
+	return ok && !expires.After(now)
+}
+
+func (s *state) drop(key string) {
+	delete(s.items, key)
+	delete(s.expires, key)
+}
+
+func (s *state) dropExpired(now time.Time) {
+	for key := range s.expires {
+		if s.expired(key, now) {
+			s.drop(key)
+		}
+	}
+}
+
+func (s *state) clone() *state {
+	return &state{
+		items:   maps.Clone(s.items),
+		expires: maps.Clone(s.expires),
+	}
+}
+
+type DB struct {
+	state
+	lock sync.RWMutex
+
+	// Optional write-ahead log the items are persisted in
+	wal *WAL
+
+	// Number of sets made, and an optional hook passing each of them on to
+	// replicas. The hook is called with `lock` held.
+	seq       uint64
+	replicate func(seq uint64, rec record)
+
+	// ID of the replication stream the sets are numbered in, if any. Saved
+	// along with `seq` on Close, to be picked up by the next OpenDB.
+	replicationID string
+
+	// Pending expiries, earliest first and by key, and the timer firing at
+	// the first
+	queue   expiryQueue
+	queued  map[string]*expiry
+	timer   *time.Timer
+	timerAt time.Time
+
+	now func() time.Time
+}
+
+// NewDB creates an in-memory DB, lost on restart.
+func NewDB() *DB {
+	return newDB(newState(), nil)
+}
+
+// OpenDB recovers the DB persisted in `dir` and persists further sets there
+// according to `policy`.
+func OpenDB(dir string, policy SyncPolicy) (*DB, error) {
+	wal, s, err := OpenWAL(dir, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	id, seq, ok, err := wal.TakeReplication()
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	db := newDB(s, wal)
+	if ok {
+		db.replicationID = id
+		db.seq = seq
+	}
+	return db, nil
+}
+
+func newDB(s *state, wal *WAL) *DB {
+	db := &DB{
+		state:  *s,
+		wal:    wal,
+		queued: map[string]*expiry{},
+		now:    time.Now,
+	}
+
+	db.lock.Lock()
+	for key, expires := range db.expires {
+		db.scheduleLocked(key, expires)
+	}
+	db.lock.Unlock()
+
+	return db
+}
+
+// Value of `key`, empty if it isn't set or has expired.
+func (db *DB) Get(key string) string {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	// The timer removing it may not have fired yet
+	if db.expired(key, db.now()) {
+		return ""
+	}
+	return db.items[key]
+}
+
+// Set `key` to `value`. The set is logged before it becomes visible, and
+// isn't applied if logging fails.
+func (db *DB) Set(key string, value string) error {
+	return db.SetWithTTL(key, value, 0)
+}
+
+// Set `key` to `value` for `ttl`, or for good if it is zero. Replaces any
+// previous expiry of the key.
+func (db *DB) SetWithTTL(key string, value string, ttl time.Duration) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = db.now().Add(ttl)
+	}
+
+	return db.applyLocked(setRecord(key, value, expires))
+}
+
+// Log and apply a set. Caller must hold `db.lock`.
+func (db *DB) applyLocked(rec record) error {
+	if db.wal != nil {
+		if err := db.wal.Append(rec); err != nil {
+			return err
+		}
+	}
+
+	if err := db.apply(rec); err != nil {
+		return err
+	}
+	if expires, ok := db.expires[rec.key]; ok {
+		db.scheduleLocked(rec.key, expires)
+	} else {
+		db.unscheduleLocked(rec.key)
+	}
+
+	db.seq++
+	if db.replicate != nil {
+		db.replicate(db.seq, rec)
+	}
+	return nil
+}
+
+// Apply a set received from the primary.
+func (db *DB) applyReplicated(rec record) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.applyLocked(rec)
+}
+
+// Replace all items with `s`, e.g. with a snapshot from the primary. The
+// DB no longer continues its own replication stream, if any.
+func (db *DB) Restore(s *state) error {
+	db.lock.Lock()
+	db.state = *s.clone()
+	db.replicationID = ""
+	db.clearScheduleLocked()
+	for key, expires := range db.expires {
+		db.scheduleLocked(key, expires)
+	}
+
+	if db.wal == nil {
+		db.lock.Unlock()
+		return nil
+	}
+
+	// Persisted as a snapshot, which supersedes everything logged before
+	gen, err := db.wal.Rotate()
+	db.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return db.wal.WriteSnapshot(gen, s)
+}
+
+// Flush logged sets to stable storage.
+func (db *DB) Sync() error {
+	if db.wal == nil {
+		return nil
+	}
+	return db.wal.Sync()
+}
+
+// Snapshot saves all items and compacts the log. Sets may proceed while the
+// snapshot is being written.
+func (db *DB) Snapshot() error {
+	if db.wal == nil {
+		return nil
+	}
+
+	db.lock.Lock()
+	gen, err := db.wal.Rotate()
+	s := db.clone()
+	db.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	s.dropExpired(db.now())
+	return db.wal.WriteSnapshot(gen, s)
+}
+
+// Close stops expiring items and closes the log. A primary's replication
+// ID is saved next to it, so that its replicas can carry on after a restart.
+func (db *DB) Close() error {
+	// No sets are made until the replication ID is saved
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.stopTimerLocked()
+
+	if db.wal == nil {
+		return nil
+	}
+	if err := db.wal.Close(); err != nil {
+		return err
+	}
+	if db.replicationID != "" {
+		return db.wal.SaveReplication(db.replicationID, db.seq)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"container/heap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type expiry struct {
+	at  time.Time
+	key string
+
+	// Position in the queue
+	index int
+}
+
+// Min-heap of expiries, holding at most one per key. Entries keep track of
+// their position, so that setting the key again can move or remove them.
+type expiryQueue []*expiry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue) Push(x any) {
+	e := x.(*expiry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *expiryQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// Expire `key` at `at`, replacing its pending expiry. Caller must hold
+// `db.lock`.
+func (db *DB) scheduleLocked(key string, at time.Time) {
+	if e, ok := db.queued[key]; ok {
+		e.at = at
+		heap.Fix(&db.queue, e.index)
+	} else {
+		e := &expiry{at: at, key: key}
+		heap.Push(&db.queue, e)
+		db.queued[key] = e
+	}
+	db.resetTimerLocked()
+}
+
+// Forget the pending expiry of `key`, if any. Caller must hold `db.lock`.
+func (db *DB) unscheduleLocked(key string) {
+	e, ok := db.queued[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&db.queue, e.index)
+	delete(db.queued, key)
+	db.resetTimerLocked()
+}
+
+// Forget all pending expiries. Caller must hold `db.lock`.
+func (db *DB) clearScheduleLocked() {
+	db.queue = nil
+	db.queued = map[string]*expiry{}
+	db.stopTimerLocked()
+}
+
+// Point the timer at the earliest pending expiry. Caller must hold
+// `db.lock`.
+func (db *DB) resetTimerLocked() {
+	if len(db.queue) == 0 {
+		db.stopTimerLocked()
+		return
+	}
+
+	next := db.queue[0].at
+	if db.timer != nil && db.timerAt.Equal(next) {
+		return
+	}
+
+	db.stopTimerLocked()
+	db.timerAt = next
+	db.timer = time.AfterFunc(next.Sub(db.now()), db.expireDue)
+}
+
+func (db *DB) stopTimerLocked() {
+	if db.timer != nil {
+		db.timer.Stop()
+		db.timer = nil
+	}
+}
+
+func (db *DB) expireDue() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// The timer is spent. Nothing may be due yet if the clock went back,
+	// so always start another one rather than assume it's still pending.
+	db.stopTimerLocked()
+	db.expireLocked(db.now())
+	db.resetTimerLocked()
+}
+
+// Drop the keys that expired by `now`. Caller must hold `db.lock`.
+func (db *DB) expireLocked(now time.Time) {
+	for len(db.queue) > 0 && !db.queue[0].at.After(now) {
+		e := heap.Pop(&db.queue).(*expiry)
+		delete(db.queued, e.key)
+		db.drop(e.key)
+	}
+}
+
+// Inserts of the form `ttl:<seconds>:key=value` set a key that expires, if
+// enabled with -ttl. Clients then have no way to set a key of that form.
+const TTLPrefix = "ttl:"
+
+// Split the key of an insert in the TTL form into the actual key and its
+// TTL. Anything else, including malformed TTLs, is a plain key.
+func parseTTLKey(key string) (string, time.Duration, bool) {
+	rest, ok := strings.CutPrefix(key, TTLPrefix)
+	if !ok {
+		return key, 0, false
+	}
+
+	seconds, actual, ok := strings.Cut(rest, ":")
+	if !ok {
+		return key, 0, false
+	}
+
+	n, err := strconv.ParseUint(seconds, 10, 32)
+	if err != nil || n == 0 {
+		return key, 0, false
+	}
+	return actual, time.Duration(n) * time.Second, true
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTTLKey(t *testing.T) {
+	tests := []struct {
+		give    string
+		wantKey string
+		wantTTL time.Duration
+		wantOK  bool
+	}{
+		{give: "ttl:60:foo", wantKey: "foo", wantTTL: time.Minute, wantOK: true},
+		{give: "ttl:1:a:b", wantKey: "a:b", wantTTL: time.Second, wantOK: true},
+		{give: "ttl:1:", wantKey: "", wantTTL: time.Second, wantOK: true},
+		{give: "foo", wantKey: "foo"},
+		{give: "ttl:foo", wantKey: "ttl:foo"},
+		{give: "ttl:0:foo", wantKey: "ttl:0:foo"},
+		{give: "ttl:-5:foo", wantKey: "ttl:-5:foo"},
+		{give: "ttl:1.5:foo", wantKey: "ttl:1.5:foo"},
+		{give: "ttl:99999999999:foo", wantKey: "ttl:99999999999:foo"},
+		{give: "TTL:60:foo", wantKey: "TTL:60:foo"},
+	}
+
+	for _, test := range tests {
+		key, ttl, ok := parseTTLKey(test.give)
+		if key != test.wantKey || ttl != test.wantTTL || ok != test.wantOK {
+			t.Errorf("%q: want %q %v %v have %q %v %v", test.give, test.wantKey, test.wantTTL, test.wantOK, key, ttl, ok)
+		}
+	}
+}
+
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func TestExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	db := NewDB()
+	db.now = clock.Now
+	defer db.Close()
+
+	db.SetWithTTL("a", "1", 10*time.Second)
+	db.SetWithTTL("b", "2", 5*time.Second)
+	db.Set("c", "3")
+
+	clock.Advance(5 * time.Second)
+
+	// Expired keys read as empty even before they are dropped
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "a", want: "1"},
+		{key: "b", want: ""},
+		{key: "c", want: "3"},
+	}
+	for _, test := range tests {
+		if have := db.Get(test.key); have != test.want {
+			t.Errorf("%s: want %q have %q", test.key, test.want, have)
+		}
+	}
+
+	db.expireDue()
+	if _, ok := db.items["b"]; ok {
+		t.Error("want b dropped")
+	}
+
+	// A plain set makes the key permanent again
+	db.Set("a", "4")
+	clock.Advance(time.Hour)
+	db.expireDue()
+	if have := db.Get("a"); have != "4" {
+		t.Errorf("want %q have %q", "4", have)
+	}
+
+	// Setting a new TTL replaces the old one
+	db.SetWithTTL("d", "5", time.Second)
+	db.SetWithTTL("d", "6", time.Minute)
+	clock.Advance(2 * time.Second)
+	db.expireDue()
+	if have := db.Get("d"); have != "6" {
+		t.Errorf("want %q have %q", "6", have)
+	}
+
+	if len(db.queue) != 1 {
+		t.Errorf("want 1 pending expiry have %d", len(db.queue))
+	}
+}
+
+func TestExpiryTimer(t *testing.T) {
+	db := NewDB()
+	defer db.Close()
+
+	db.SetWithTTL("a", "1", 10*time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		db.lock.RLock()
+		_, ok := db.items["a"]
+		db.lock.RUnlock()
+
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("key never expired")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestExpiryQueueBounded(t *testing.T) {
+	db := NewDB()
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		db.SetWithTTL("a", "1", time.Duration(100-i)*time.Hour)
+		db.SetWithTTL("b", "2", time.Duration(i+1)*time.Hour)
+	}
+	if len(db.queue) != 2 {
+		t.Errorf("want 2 pending expiries have %d", len(db.queue))
+	}
+	if have, want := db.queue[0].key, "a"; have != want {
+		t.Errorf("want %q first have %q", want, have)
+	}
+
+	db.Set("a", "3")
+	if len(db.queue) != 1 || db.queue[0].key != "b" {
+		t.Errorf("want only b pending have %d expiries", len(db.queue))
+	}
+}
+
+func TestExpiryTimerRearms(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	db := NewDB()
+	db.now = clock.Now
+	defer db.Close()
+
+	// The timer fires while the clock says nothing is due yet
+	db.SetWithTTL("a", "1", 10*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	clock.Advance(time.Second)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		db.lock.RLock()
+		_, ok := db.items["a"]
+		db.lock.RUnlock()
+
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("key never expired")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestExpiryPersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	db.SetWithTTL("short", "1", 10*time.Millisecond)
+	db.SetWithTTL("long", "2", time.Hour)
+	if err := db.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	db.SetWithTTL("logged", "3", 10*time.Millisecond)
+	db.SetWithTTL("plain", "4", time.Hour)
+	db.Set("plain", "5")
+	expires := db.expires["long"]
+	db.Close()
+
+	time.Sleep(20 * time.Millisecond)
+
+	db = openDB(t, dir)
+	defer db.Close()
+
+	want := map[string]string{"long": "2", "plain": "5"}
+	for key, value := range want {
+		if have := db.Get(key); have != value {
+			t.Errorf("%s: want %q have %q", key, value, have)
+		}
+	}
+	if len(db.items) != len(want) {
+		t.Errorf("want %v have %v", want, db.items)
+	}
+
+	if have := db.expires["long"]; !have.Equal(expires) {
+		t.Errorf("want %v have %v", expires, have)
+	}
+	if len(db.queue) != 1 {
+		t.Errorf("want 1 pending expiry have %d", len(db.queue))
+	}
+}
+
+func TestTTLInsert(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	tests := []struct {
+		allowTTL bool
+		give     string
+		key      string
+	}{
+		{allowTTL: false, give: "ttl:60:foo", key: "ttl:60:foo"},
+		{allowTTL: false, give: "ttl:1:", key: "ttl:1:"},
+		{allowTTL: false, give: "ttl:", key: "ttl:"},
+		{allowTTL: false, give: "foo", key: "foo"},
+		{allowTTL: true, give: "ttl:60:foo", key: "foo"},
+		{allowTTL: true, give: "ttl:0:foo", key: "ttl:0:foo"},
+		{allowTTL: true, give: "foo", key: "foo"},
+	}
+
+	for _, test := range tests {
+		srv := &server{db: NewDB(), pc: pc, allowTTL: test.allowTTL}
+		srv.handleRequest(pc.LocalAddr(), []byte(test.give+"=bar"))
+
+		if have := srv.db.Get(test.key); have != "bar" {
+			t.Errorf("%q ttl %v: want %q set have %q", test.give, test.allowTTL, test.key, have)
+		}
+		if len(srv.db.items) != 1 {
+			t.Errorf("%q ttl %v: want 1 key have %v", test.give, test.allowTTL, srv.db.items)
+		}
+		wantExpiry := test.give != test.key
+		if _, ok := srv.db.expires[test.key]; ok != wantExpiry {
+			t.Errorf("%q ttl %v: want expiry %v have %v", test.give, test.allowTTL, wantExpiry, ok)
+		}
+		srv.db.Close()
+	}
+}
@@ -1,40 +1,45 @@
+// Command unusual-db serves the Unusual Database Program key-value store.
+//
+// With -ttl, an insert whose key reads ttl:<seconds>:<key> sets <key> to
+// expire after that many seconds. The protocol allows any key, so such keys
+// can no longer be set literally: leave -ttl off if clients may use them.
+//
+// With -replicate-from, the store is a read-only replica of another one
+// running with -replication-addr. It answers queries from its copy of the
+// data, while inserts sent to it are dropped without a reply, just like
+// inserts of the version key: clients must send them to the primary.
+// Replicas prove to the primary that they know the -replication-secret.
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 const Version string = "KeeValue Store 6.9"
 
-type DB struct {
-	items map[string]string
-	lock  sync.RWMutex
-}
-
-func NewDB() *DB {
-	return &DB{
-		items: make(map[string]string),
-	}
-}
+type server struct {
+	db *DB
+	pc net.PacketConn
 
-func (db *DB) Get(key string) string {
-	db.lock.RLock()
-	defer db.lock.RUnlock()
+	// Whether inserts may use the TTL extension
+	allowTTL bool
 
-	return db.items[key]
+	// Replicas serve reads but ignore inserts, as only the primary may
+	// change the data
+	readOnly bool
 }
 
-func (db *DB) Set(key string, value string) {
-	db.lock.Lock()
-	defer db.lock.Unlock()
-
-	db.items[key] = value
-}
-
-func handleRequest(db *DB, pc net.PacketConn, addr net.Addr, data []byte) {
+func (srv *server) handleRequest(addr net.Addr, data []byte) {
 	// Max request length
 	if len(data) > 1000 {
 		return
@@ -42,8 +47,20 @@ func handleRequest(db *DB, pc net.PacketConn, addr net.Addr, data []byte) {
 
 	key, value, isInsert := strings.Cut(string(data), "=")
 	if isInsert {
+		var ttl time.Duration
+		if srv.allowTTL {
+			key, ttl, _ = parseTTLKey(key)
+		}
+
+		if srv.readOnly {
+			log.Printf("Ignoring insert of %q from %s: read-only replica\n", key, addr)
+			return
+		}
+
 		if key != "version" {
-			db.Set(key, value)
+			if err := srv.db.SetWithTTL(key, value, ttl); err != nil {
+				log.Printf("Failed to set %q: %s\n", key, err)
+			}
 		}
 	} else {
 		var result string
@@ -51,35 +68,149 @@ func handleRequest(db *DB, pc net.PacketConn, addr net.Addr, data []byte) {
 		if key == "version" {
 			result = Version
 		} else {
-			result = db.Get(key)
+			result = srv.db.Get(key)
 		}
 
 		payload := strings.Join([]string{key, result}, "=")
-		if _, err := pc.WriteTo([]byte(payload), addr); err != nil {
+		if _, err := srv.pc.WriteTo([]byte(payload), addr); err != nil {
 			log.Printf("UDP write error: %s\n", err)
 		}
 	}
 }
 
+// Run `fn` every `interval` until `ctx` is done.
+func every(ctx context.Context, interval time.Duration, what string, fn func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := fn(); err != nil {
+				log.Printf("ERROR: %s failed: %s\n", what, err)
+			}
+		}
+	}
+}
+
 func main() {
-	pc, err := net.ListenPacket("udp", ":10000")
+	address := flag.String("addr", ":10000", "UDP address to listen on")
+	dataDir := flag.String("data-dir", "", "directory to persist the database in (in-memory only if empty)")
+	syncPolicy := flag.String("fsync", SyncAlways.String(), "when to sync the write-ahead log: always, interval or never")
+	syncInterval := flag.Duration("fsync-interval", time.Second, "how often to sync the write-ahead log with -fsync interval")
+	allowTTL := flag.Bool("ttl", false, "accept inserts of the form "+TTLPrefix+"<seconds>:key=value for keys that expire (such keys can't then be set literally)")
+	replicationAddress := flag.String("replication-addr", "", "TCP address to accept replicas on as the primary (disabled if empty)")
+	primaryAddress := flag.String("replicate-from", "", "run as a replica of the primary accepting replicas at this address, dropping inserts sent to it")
+	replicationSecret := flag.String("replication-secret", "", "secret shared by the primary and its replicas, required to replicate")
+	snapshotInterval := flag.Duration("snapshot-interval", 5*time.Minute, "how often to snapshot the database and compact the log (0 to disable)")
+	flag.Parse()
+
+	// Done on shutdown, which waits for the background work to stop before
+	// the DB is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+	run := func(fn func()) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			fn()
+		}()
+	}
+
+	db := NewDB()
+	if *dataDir != "" {
+		policy, err := ParseSyncPolicy(*syncPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		db, err = OpenDB(*dataDir, policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if policy == SyncInterval {
+			run(func() { every(ctx, *syncInterval, "Sync", db.Sync) })
+		}
+		if *snapshotInterval > 0 {
+			run(func() { every(ctx, *snapshotInterval, "Snapshot", db.Snapshot) })
+		}
+	}
+	defer db.Close()
+	defer background.Wait()
+	defer cancel()
+
+	if *replicationAddress != "" && *primaryAddress != "" {
+		log.Fatal("a replica can't be a primary at the same time")
+	}
+	if (*replicationAddress != "" || *primaryAddress != "") && *replicationSecret == "" {
+		log.Fatal("-replication-secret is required to replicate")
+	}
+
+	if *replicationAddress != "" {
+		ln, err := net.Listen("tcp", *replicationAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer ln.Close()
+
+		p := NewPrimary(db)
+		p.Secret = *replicationSecret
+		go func() {
+			if err := p.Serve(ln); !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if *primaryAddress != "" {
+		r := NewReplica(db, *primaryAddress)
+		r.Secret = *replicationSecret
+		run(func() { r.Run(ctx, time.Second) })
+	}
+
+	pc, err := net.ListenPacket("udp", *address)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer pc.Close()
 
-	db := NewDB()
+	srv := &server{db: db, pc: pc, allowTTL: *allowTTL, readOnly: *primaryAddress != ""}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		// Stop reading, but leave the socket open for the replies still
+		// being sent
+		log.Println("Shutting down")
+		cancel()
+		pc.SetReadDeadline(time.Now())
+	}()
+
+	var requests sync.WaitGroup
+	defer requests.Wait()
 
 	for {
 		b := make([]byte, 1024)
 		n, addr, err := pc.ReadFrom(b)
 		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("UDP read error: %s\n", err)
 			continue
 		}
 
 		log.Printf("Received %d byte long packet from %s\n", n, addr.String())
 
-		go handleRequest(db, pc, addr, b[:n])
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			srv.handleRequest(addr, b[:n])
+		}()
 	}
 }
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Replication messages are records as in the write-ahead log, preceded by an
+// 8 byte big endian sequence number. Besides sets they carry these
+// operations, with the replication ID in the key:
+const (
+	// Replica to primary: last sequence number seen from the primary with
+	// this ID, zero and no ID if none. The value proves that the replica
+	// knows the shared secret, as the hex HMAC of the challenge nonce.
+	opHello byte = 16
+
+	// Primary to replica: items as of this sequence number follow as sets,
+	// terminated by opSnapshotEnd.
+	opSnapshot    byte = 17
+	opSnapshotEnd byte = 18
+
+	// Primary to replica: sets after this sequence number follow.
+	opContinue byte = 19
+
+	// Primary to replica, first thing on connect: a random nonce in the
+	// key for the hello to answer.
+	opChallenge byte = 20
+)
+
+const (
+	// Default number of recent sets kept by the primary for replicas to
+	// catch up from. Replicas further behind are sent a snapshot.
+	DefaultBacklogSize = 10000
+
+	// Number of sets a replica may have pending before it is disconnected.
+	ReplicaQueueSize = 1024
+
+	// How long the other side may take to accept a message, or a replica
+	// to say hello
+	replicationTimeout = 10 * time.Second
+)
+
+var (
+	ErrReplicationProtocol = errors.New("replication protocol violation")
+	ErrReplicaRejected     = errors.New("replica rejected: wrong secret")
+	ErrNoReplicationSecret = errors.New("no replication secret configured")
+)
+
+// Proof of knowing `secret`, in answer to `nonce`.
+func replicationMAC(secret, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func appendMessage(buf []byte, seq uint64, rec record) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, seq)
+	return appendRecord(buf, rec)
+}
+
+func readMessage(r *bufio.Reader) (uint64, record, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, record{}, err
+	}
+
+	rec, _, err := readRecord(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return binary.BigEndian.Uint64(header[:]), rec, err
+}
+
+func isSet(rec record) bool {
+	return rec.op == opSet || rec.op == opSetExpiring
+}
+
+type replicated struct {
+	seq uint64
+	rec record
+}
+
+// Connection of a replica to the primary.
+type replicaConn struct {
+	conn  net.Conn
+	queue chan []byte
+}
+
+// Primary streams the sets made to its DB to replicas.
+type Primary struct {
+	db *DB
+
+	// Random per DB, so that replicas of another one resync. Carried over
+	// a restart if the DB was closed cleanly.
+	id string
+
+	lock     sync.Mutex
+	backlog  []replicated
+	next     int
+	replicas map[*replicaConn]bool
+
+	// Number of recent sets kept for replicas catching up. Must be set
+	// before any sets are made.
+	BacklogSize int
+
+	// Secret shared with replicas, which must prove they know it. Must be
+	// set before Serve.
+	Secret string
+}
+
+// NewPrimary starts replicating `db`. Must be called before any sets are
+// made that replicas should see.
+func NewPrimary(db *DB) *Primary {
+	p := &Primary{
+		db:          db,
+		replicas:    map[*replicaConn]bool{},
+		BacklogSize: DefaultBacklogSize,
+	}
+
+	db.lock.Lock()
+	if db.replicationID == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		db.replicationID = hex.EncodeToString(id)
+	}
+	p.id = db.replicationID
+	db.replicate = p.publish
+	db.lock.Unlock()
+
+	return p
+}
+
+// Queue a set for every replica. Called with `db.lock` held, so sets are
+// published in order.
+func (p *Primary) publish(seq uint64, rec record) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.BacklogSize > 0 {
+		if len(p.backlog) < p.BacklogSize {
+			p.backlog = append(p.backlog, replicated{seq: seq, rec: rec})
+		} else {
+			p.backlog[p.next] = replicated{seq: seq, rec: rec}
+			p.next = (p.next + 1) % len(p.backlog)
+		}
+	}
+
+	msg := appendMessage(nil, seq, rec)
+	for r := range p.replicas {
+		select {
+		case r.queue <- msg:
+		default:
+			// It will catch up once it reconnects
+			log.Printf("Dropping replica %s: send queue full\n", r.conn.RemoteAddr())
+			p.dropLocked(r)
+		}
+	}
+}
+
+func (p *Primary) dropLocked(r *replicaConn) {
+	if p.replicas[r] {
+		delete(p.replicas, r)
+		close(r.queue)
+		r.conn.Close()
+	}
+}
+
+// Sets after `seq`, oldest first, if the backlog still has all of them.
+// Caller must hold `p.lock`.
+func (p *Primary) backlogSinceLocked(seq uint64) ([]replicated, bool) {
+	ordered := append(append([]replicated{}, p.backlog[p.next:]...), p.backlog[:p.next]...)
+
+	if seq == p.db.seq {
+		return nil, true
+	}
+	if len(ordered) == 0 || ordered[0].seq > seq+1 {
+		return nil, false
+	}
+	return ordered[seq+1-ordered[0].seq:], true
+}
+
+// Writer to a replica, which may take up to replicationTimeout to accept
+// every write.
+type deadlineWriter struct {
+	conn net.Conn
+}
+
+func (w deadlineWriter) Write(b []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+	return w.conn.Write(b)
+}
+
+// Bring a replica from `seq` of replication `id` up to date, then register
+// it for further sets. Catch-ups are written without holding any locks, so
+// sets go on meanwhile and are caught up on in turn, until few enough are
+// missing to queue them along with the registration.
+func (p *Primary) attach(r *replicaConn, out *bufio.Writer, id string, seq uint64) error {
+	for {
+		missed, snapshot, at, done := p.catchUp(r, id, seq)
+		if done {
+			return nil
+		}
+
+		// Encoded a message at a time, as there may be many items
+		var buf []byte
+		write := func(seq uint64, rec record) {
+			buf = appendMessage(buf[:0], seq, rec)
+			out.Write(buf)
+		}
+
+		if snapshot != nil {
+			write(at, record{op: opSnapshot, key: p.id})
+			now := p.db.now()
+			for key, value := range snapshot.items {
+				if !snapshot.expired(key, now) {
+					write(0, snapshot.record(key, value))
+				}
+			}
+			write(at, record{op: opSnapshotEnd, key: p.id})
+		} else {
+			write(seq, record{op: opContinue, key: p.id})
+			for _, m := range missed {
+				write(m.seq, m.rec)
+			}
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+
+		id, seq = p.id, at
+	}
+}
+
+// What a replica at `seq` of replication `id` is missing: either the sets
+// since, or a copy of all items as of set `at`. If no snapshot is needed
+// and the sets fit in its queue, the replica is registered with them queued
+// instead.
+func (p *Primary) catchUp(r *replicaConn, id string, seq uint64) ([]replicated, *state, uint64, bool) {
+	// No sets are made while the replica is registered
+	p.db.lock.RLock()
+	defer p.db.lock.RUnlock()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	at := p.db.seq
+	if id == p.id && seq <= at {
+		if missed, ok := p.backlogSinceLocked(seq); ok {
+			if len(missed) < cap(r.queue) {
+				r.queue <- appendMessage(nil, seq, record{op: opContinue, key: p.id})
+				for _, m := range missed {
+					r.queue <- appendMessage(nil, m.seq, m.rec)
+				}
+				p.replicas[r] = true
+				return nil, nil, at, true
+			}
+			return missed, nil, at, false
+		}
+	}
+
+	return nil, p.db.clone(), at, false
+}
+
+func (p *Primary) serveReplica(conn net.Conn) error {
+	defer conn.Close()
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	challenge := hex.EncodeToString(nonce)
+
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	if _, err := conn.Write(appendMessage(nil, 0, record{op: opChallenge, key: challenge})); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	seq, hello, err := readMessage(r)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	if hello.op != opHello {
+		return ErrReplicationProtocol
+	}
+	want := replicationMAC(p.Secret, challenge)
+	if subtle.ConstantTimeCompare([]byte(hello.value), []byte(want)) != 1 {
+		return ErrReplicaRejected
+	}
+
+	rc := &replicaConn{conn: conn, queue: make(chan []byte, ReplicaQueueSize)}
+	defer func() {
+		p.lock.Lock()
+		p.dropLocked(rc)
+		p.lock.Unlock()
+	}()
+
+	// Replicas don't send anything else, reading only notices them leaving
+	go func() {
+		io.Copy(io.Discard, r)
+		p.lock.Lock()
+		p.dropLocked(rc)
+		p.lock.Unlock()
+		conn.Close()
+	}()
+
+	out := bufio.NewWriter(deadlineWriter{conn: conn})
+	if err := p.attach(rc, out, hello.key, seq); err != nil {
+		return err
+	}
+
+	for msg := range rc.queue {
+		out.Write(msg)
+		if len(rc.queue) > 0 {
+			continue
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serve accepts replicas knowing the Secret on `ln`.
+func (p *Primary) Serve(ln net.Listener) error {
+	if p.Secret == "" {
+		ln.Close()
+		return ErrNoReplicationSecret
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		log.Printf("New replica: %s\n", conn.RemoteAddr())
+
+		go func() {
+			err := p.serveReplica(conn)
+			log.Printf("Replica %s dropped: %v\n", conn.RemoteAddr(), err)
+		}()
+	}
+}
+
+// Replica keeps its DB in sync with a primary. The DB must not be written
+// to otherwise.
+type Replica struct {
+	db      *DB
+	address string
+
+	// Position in the primary's stream of sets
+	lock sync.Mutex
+	id   string
+	seq  uint64
+
+	// Number of snapshots received, for tests
+	snapshots int
+
+	// Secret shared with the primary. Must be set before Sync or Run.
+	Secret string
+}
+
+func NewReplica(db *DB, address string) *Replica {
+	return &Replica{db: db, address: address}
+}
+
+// Replication ID and sequence number of the last set applied.
+func (r *Replica) Position() (string, uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.id, r.seq
+}
+
+// Sync answers the primary's challenge on `conn`, catches up and applies
+// its sets until the connection drops or `conn` is closed.
+func (r *Replica) Sync(conn net.Conn) error {
+	defer conn.Close()
+
+	if r.Secret == "" {
+		return ErrNoReplicationSecret
+	}
+
+	in := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	_, challenge, err := readMessage(in)
+	if err != nil {
+		return err
+	}
+	if challenge.op != opChallenge {
+		return ErrReplicationProtocol
+	}
+
+	id, seq := r.Position()
+	hello := record{op: opHello, key: id, value: replicationMAC(r.Secret, challenge.key)}
+	if _, err := conn.Write(appendMessage(nil, seq, hello)); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	var snapshot *state
+
+	for {
+		seq, rec, err := readMessage(in)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case rec.op == opSnapshot && snapshot == nil:
+			snapshot = newState()
+		case rec.op == opSnapshotEnd && snapshot != nil:
+			if err := r.db.Restore(snapshot); err != nil {
+				return err
+			}
+			snapshot = nil
+			r.restored(rec.key, seq)
+		case isSet(rec) && snapshot != nil:
+			if err := snapshot.apply(rec); err != nil {
+				return err
+			}
+		case rec.op == opContinue && snapshot == nil:
+			if id, current := r.Position(); rec.key != id || seq != current {
+				return ErrReplicationProtocol
+			}
+		case isSet(rec):
+			if _, current := r.Position(); seq != current+1 {
+				return fmt.Errorf("%w: want set %d have %d", ErrReplicationProtocol, current+1, seq)
+			}
+			if err := r.db.applyReplicated(rec); err != nil {
+				return err
+			}
+			r.applied(seq)
+		default:
+			return ErrReplicationProtocol
+		}
+	}
+}
+
+func (r *Replica) restored(id string, seq uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.id = id
+	r.seq = seq
+	r.snapshots++
+}
+
+func (r *Replica) applied(seq uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.seq = seq
+}
+
+// Run keeps syncing with the primary, reconnecting `retry` after the
+// connection drops, until `ctx` is done. Returns the context's error.
+func (r *Replica) Run(ctx context.Context, retry time.Duration) error {
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", r.address)
+		if err == nil {
+			log.Printf("Replicating from %s\n", r.address)
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			err = r.Sync(conn)
+			stop()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("Replication from %s stopped: %s\n", r.address, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
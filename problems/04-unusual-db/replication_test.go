@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "swordfish"
+
+// Serve replicas of `db` on loopback.
+func startPrimary(t *testing.T, db *DB) (*Primary, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	p := NewPrimary(db)
+	p.Secret = testSecret
+	go p.Serve(ln)
+
+	return p, ln.Addr().String()
+}
+
+func newReplica(db *DB, address string) *Replica {
+	r := NewReplica(db, address)
+	r.Secret = testSecret
+	return r
+}
+
+// Sync `r` with the primary at `address` until the returned func is called.
+func startReplica(t *testing.T, r *Replica, address string) func() {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- r.Sync(conn) }()
+
+	stop := func() {
+		conn.Close()
+		<-stopped
+	}
+	t.Cleanup(func() { conn.Close() })
+	return stop
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Wait for `r` to catch up with `p` and compare their contents.
+func expectInSync(t *testing.T, p *Primary, r *Replica) {
+	t.Helper()
+
+	p.db.lock.RLock()
+	seq := p.db.seq
+	p.db.lock.RUnlock()
+
+	waitFor(t, fmt.Sprintf("set %d", seq), func() bool {
+		id, have := r.Position()
+		return id == p.id && have == seq
+	})
+
+	p.db.lock.RLock()
+	defer p.db.lock.RUnlock()
+	r.db.lock.RLock()
+	defer r.db.lock.RUnlock()
+
+	if !maps.Equal(p.db.items, r.db.items) {
+		t.Errorf("want %v have %v", p.db.items, r.db.items)
+	}
+	if !maps.EqualFunc(p.db.expires, r.db.expires, time.Time.Equal) {
+		t.Errorf("want expiries %v have %v", p.db.expires, r.db.expires)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	db := NewDB()
+	db.Set("before", "1")
+	db.SetWithTTL("expiring", "2", time.Hour)
+
+	p, address := startPrimary(t, db)
+	db.Set("after", "3")
+
+	replicas := []*Replica{
+		newReplica(NewDB(), address),
+		newReplica(NewDB(), address),
+	}
+	for _, r := range replicas {
+		startReplica(t, r, address)
+	}
+
+	db.Set("before", "4")
+	db.SetWithTTL("live", "5", time.Minute)
+	db.Set("weird=key\n", "\xff\x00")
+
+	for _, r := range replicas {
+		expectInSync(t, p, r)
+		if r.snapshots != 1 {
+			t.Errorf("want 1 snapshot have %d", r.snapshots)
+		}
+	}
+}
+
+func TestReplicationCatchUp(t *testing.T) {
+	tests := []struct {
+		backlog       int
+		wantSnapshots int
+	}{
+		{backlog: DefaultBacklogSize, wantSnapshots: 1},
+		{backlog: 3, wantSnapshots: 2},
+		{backlog: 0, wantSnapshots: 2},
+	}
+
+	for _, test := range tests {
+		db := NewDB()
+		p, address := startPrimary(t, db)
+		p.BacklogSize = test.backlog
+
+		r := newReplica(NewDB(), address)
+		stop := startReplica(t, r, address)
+		db.Set("a", "1")
+		expectInSync(t, p, r)
+		stop()
+
+		// Fall behind by more than a small backlog
+		for i := 0; i < 10; i++ {
+			db.Set(fmt.Sprint("key", i), fmt.Sprint(i))
+		}
+
+		startReplica(t, r, address)
+		expectInSync(t, p, r)
+		if r.snapshots != test.wantSnapshots {
+			t.Errorf("backlog %d: want %d snapshots have %d", test.backlog, test.wantSnapshots, r.snapshots)
+		}
+
+		// Streaming resumes after catching up
+		db.Set("b", "2")
+		expectInSync(t, p, r)
+	}
+}
+
+func TestReplicationPrimaryRestart(t *testing.T) {
+	dir := t.TempDir()
+	r := newReplica(openDB(t, dir), "")
+
+	db := NewDB()
+	db.Set("old", "1")
+	p, address := startPrimary(t, db)
+	stop := startReplica(t, r, address)
+	expectInSync(t, p, r)
+	stop()
+
+	// A new primary process starts over from sequence number 0
+	db = NewDB()
+	db.Set("new", "2")
+	p, address = startPrimary(t, db)
+	stop = startReplica(t, r, address)
+	expectInSync(t, p, r)
+	stop()
+
+	// The snapshot is persisted by the replica
+	r.db.Close()
+	replicaDB := openDB(t, dir)
+	defer replicaDB.Close()
+
+	want := map[string]string{"new": "2"}
+	if !maps.Equal(replicaDB.items, want) {
+		t.Errorf("want %v have %v", want, replicaDB.items)
+	}
+}
+
+func TestReplicationWrongSecret(t *testing.T) {
+	db := NewDB()
+	db.Set("secret", "1")
+	p, address := startPrimary(t, db)
+
+	tests := []string{"", "hunter2"}
+	for _, secret := range tests {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewReplica(NewDB(), address)
+		r.Secret = secret
+		err = r.Sync(conn)
+		if err == nil {
+			t.Errorf("%q: want error have nil", secret)
+		}
+		if len(r.db.items) != 0 {
+			t.Errorf("%q: want no items have %v", secret, r.db.items)
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.replicas) != 0 {
+		t.Errorf("want no replicas have %d", len(p.replicas))
+	}
+}
+
+func TestReplicaRun(t *testing.T) {
+	db := NewDB()
+	db.Set("a", "1")
+	p, address := startPrimary(t, db)
+
+	r := newReplica(NewDB(), address)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- r.Run(ctx, time.Millisecond) }()
+	expectInSync(t, p, r)
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("want %v have %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("replica kept running")
+	}
+
+	// Nothing is applied once Run has returned
+	db.Set("b", "2")
+	time.Sleep(10 * time.Millisecond)
+	if have := r.db.Get("b"); have != "" {
+		t.Errorf("want %q have %q", "", have)
+	}
+}
+
+// Conn that stalls its second read, the first after the challenge, until
+// `resume` is closed.
+type stallConn struct {
+	net.Conn
+	reads  int
+	resume chan struct{}
+}
+
+func (c *stallConn) Read(b []byte) (int, error) {
+	if c.reads++; c.reads == 2 {
+		<-c.resume
+	}
+	return c.Conn.Read(b)
+}
+
+func TestReplicationSlowCatchUp(t *testing.T) {
+	tests := []struct {
+		backlog       int
+		wantSnapshots int
+	}{
+		{backlog: DefaultBacklogSize, wantSnapshots: 1},
+		{backlog: 0, wantSnapshots: 2},
+	}
+
+	for _, test := range tests {
+		db := NewDB()
+		for i := 0; i < 100; i++ {
+			db.Set(fmt.Sprint("old", i), fmt.Sprint(i))
+		}
+		p := NewPrimary(db)
+		p.Secret = testSecret
+		p.BacklogSize = test.backlog
+
+		local, remote := net.Pipe()
+		t.Cleanup(func() { local.Close() })
+		go p.serveReplica(local)
+
+		r := newReplica(NewDB(), "")
+		resume := make(chan struct{})
+		go r.Sync(&stallConn{Conn: remote, resume: resume})
+
+		// More sets than a replica may have queued, made while it's stuck
+		// on the snapshot
+		time.Sleep(20 * time.Millisecond)
+		for i := 0; i < 2*ReplicaQueueSize; i++ {
+			db.Set(fmt.Sprint("new", i), fmt.Sprint(i))
+		}
+		close(resume)
+
+		expectInSync(t, p, r)
+		if r.snapshots != test.wantSnapshots {
+			t.Errorf("backlog %d: want %d snapshots have %d", test.backlog, test.wantSnapshots, r.snapshots)
+		}
+
+		db.Set("live", "1")
+		expectInSync(t, p, r)
+	}
+}
+
+func TestReplicationPrimaryResume(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	db.Set("a", "1")
+	p, address := startPrimary(t, db)
+	r := newReplica(NewDB(), address)
+	stop := startReplica(t, r, address)
+	expectInSync(t, p, r)
+	stop()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cleanly closed primary carries on where it left off
+	db = openDB(t, dir)
+	defer db.Close()
+	resumed, address := startPrimary(t, db)
+	if resumed.id != p.id {
+		t.Errorf("want id %q have %q", p.id, resumed.id)
+	}
+	db.Set("b", "2")
+	startReplica(t, r, address)
+	expectInSync(t, resumed, r)
+	if r.snapshots != 1 {
+		t.Errorf("want 1 snapshot have %d", r.snapshots)
+	}
+
+	// One that crashed starts a new stream
+	crashed := NewPrimary(openDB(t, dir))
+	defer crashed.db.Close()
+	if crashed.id == resumed.id {
+		t.Errorf("want new id have %q", crashed.id)
+	}
+}
+
+// Serve the UDP protocol on loopback.
+func startServer(t *testing.T, srv *server) net.Addr {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	srv.pc = pc
+
+	go func() {
+		for {
+			b := make([]byte, 1024)
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			srv.handleRequest(addr, b[:n])
+		}
+	}()
+
+	return pc.LocalAddr()
+}
+
+func TestReplicaServer(t *testing.T) {
+	primaryDB := NewDB()
+	p, address := startPrimary(t, primaryDB)
+	r := newReplica(NewDB(), address)
+	startReplica(t, r, address)
+
+	primary := startServer(t, &server{db: primaryDB})
+	replica := startServer(t, &server{db: r.db, readOnly: true})
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	query := func(addr net.Addr, key string) string {
+		t.Helper()
+
+		client.SetDeadline(time.Now().Add(time.Second))
+		client.WriteTo([]byte(key), addr)
+		b := make([]byte, 1024)
+		n, _, err := client.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, value, _ := strings.Cut(string(b[:n]), "=")
+		return value
+	}
+
+	// Inserts have no reply, so wait for the primary to have them
+	client.WriteTo([]byte("foo=bar"), primary)
+	waitFor(t, "insert on primary", func() bool { return query(primary, "foo") == "bar" })
+	expectInSync(t, p, r)
+
+	if value := query(replica, "foo"); value != "bar" {
+		t.Errorf("want %q have %q", "bar", value)
+	}
+
+	client.WriteTo([]byte("foo=baz"), replica)
+	client.WriteTo([]byte("new=value"), replica)
+	if value := query(replica, "foo"); value != "bar" {
+		t.Errorf("want %q have %q", "bar", value)
+	}
+	if value := query(replica, "new"); value != "" {
+		t.Errorf("want insert rejected have %q", value)
+	}
+	if value := query(replica, "version"); value != Version {
+		t.Errorf("want %q have %q", Version, value)
+	}
+}
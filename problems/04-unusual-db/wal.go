@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When to flush the write-ahead log to stable storage.
+type SyncPolicy int
+
+const (
+	// Sync after every set. Slowest, but no acknowledged set is ever lost.
+	SyncAlways SyncPolicy = iota
+
+	// Sync periodically, losing at most the sets of one interval on a crash.
+	SyncInterval
+
+	// Leave it to the operating system.
+	SyncNever
+)
+
+var syncPolicyNames = map[SyncPolicy]string{
+	SyncAlways:   "always",
+	SyncInterval: "interval",
+	SyncNever:    "never",
+}
+
+func (p SyncPolicy) String() string {
+	return syncPolicyNames[p]
+}
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	for policy, name := range syncPolicyNames {
+		if name == s {
+			return policy, nil
+		}
+	}
+	return SyncAlways, fmt.Errorf("unknown sync policy %q", s)
+}
+
+// Records are framed as a 4 byte big endian payload length and a 4 byte
+// CRC-32 of the payload, followed by the payload itself: an operation byte,
+// the expiry deadline as 8 byte big endian Unix nanoseconds for expiring
+// sets only, the uvarint length of the key, the key and the value.
+const (
+	recordHeaderSize = 8
+
+	// Anything longer is garbage, requests are limited to 1000 bytes
+	maxRecordSize = 64 * 1024
+)
+
+// Operations stored in records.
+const (
+	opSet         byte = 1
+	opSetExpiring byte = 2
+)
+
+var (
+	ErrCorruptRecord = errors.New("corrupt record")
+	ErrWALClosed     = errors.New("write-ahead log closed")
+)
+
+type record struct {
+	op    byte
+	key   string
+	value string
+
+	// Unix nanoseconds the key expires at, for opSetExpiring
+	expires int64
+}
+
+func appendRecord(buf []byte, rec record) []byte {
+	payload := []byte{rec.op}
+	if rec.op == opSetExpiring {
+		payload = binary.BigEndian.AppendUint64(payload, uint64(rec.expires))
+	}
+	payload = binary.AppendUvarint(payload, uint64(len(rec.key)))
+	payload = append(payload, rec.key...)
+	payload = append(payload, rec.value...)
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+	return append(buf, payload...)
+}
+
+// Read the next record from `r` along with its size. Returns io.EOF at the
+// end of the input and io.ErrUnexpectedEOF if it ends in the middle of a
+// record, as it does when a write was cut short by a crash.
+func readRecord(r *bufio.Reader) (record, int, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return record{}, 0, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:4])
+	if size == 0 || size > maxRecordSize {
+		return record{}, 0, ErrCorruptRecord
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return record{}, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return record{}, 0, ErrCorruptRecord
+	}
+
+	rec := record{op: payload[0]}
+	rest := payload[1:]
+	if rec.op == opSetExpiring {
+		if len(rest) < 8 {
+			return record{}, 0, ErrCorruptRecord
+		}
+		rec.expires = int64(binary.BigEndian.Uint64(rest))
+		rest = rest[8:]
+	}
+
+	keyLength, n := binary.Uvarint(rest)
+	if n <= 0 || keyLength > uint64(len(rest)-n) {
+		return record{}, 0, ErrCorruptRecord
+	}
+	rec.key = string(rest[n : n+int(keyLength)])
+	rec.value = string(rest[n+int(keyLength):])
+
+	return rec, recordHeaderSize + int(size), nil
+}
+
+// WAL persists a DB in a directory as a snapshot of all items plus logs of
+// the sets made since. Each log belongs to a generation, and the snapshot of
+// generation N holds everything written to the logs before log N.
+type WAL struct {
+	dir    string
+	policy SyncPolicy
+
+	lock   sync.Mutex
+	gen    uint64
+	f      *os.File
+	dirty  bool
+	closed bool
+
+	// Only one snapshot may be written at a time
+	snapshotLock sync.Mutex
+}
+
+func logName(gen uint64) string {
+	return fmt.Sprintf("wal-%020d.log", gen)
+}
+
+func snapshotName(gen uint64) string {
+	return fmt.Sprintf("snapshot-%020d", gen)
+}
+
+// Generation of a log or snapshot file called `name`.
+func parseGeneration(name, prefix, suffix string) (uint64, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return 0, false
+	}
+	gen, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), 10, 64)
+	return gen, err == nil
+}
+
+// OpenWAL recovers the items persisted in `dir`, creating it if needed, and
+// opens the log for further sets. A log that ends in a partial or corrupt
+// record, as left behind by a crash, is truncated to its last good record.
+// Items that have expired in the meantime are left out.
+func OpenWAL(dir string, policy SyncPolicy) (*WAL, *state, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var snapshots, logs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if gen, ok := parseGeneration(name, "snapshot-", ""); ok {
+			snapshots = append(snapshots, gen)
+		} else if gen, ok := parseGeneration(name, "wal-", ".log"); ok {
+			logs = append(logs, gen)
+		} else if strings.HasPrefix(name, ".snapshot-") || strings.HasPrefix(name, ".replication-") {
+			// Snapshot or replication file that was never completed
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	slices.Sort(snapshots)
+	slices.Sort(logs)
+
+	w := &WAL{dir: dir, policy: policy}
+	s := newState()
+
+	if len(snapshots) > 0 {
+		w.gen = snapshots[len(snapshots)-1]
+		if err := w.loadSnapshot(w.gen, s); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", snapshotName(w.gen), err)
+		}
+	}
+
+	for i, gen := range logs {
+		if gen < w.gen {
+			continue
+		}
+		if err := w.replay(gen, s, i == len(logs)-1); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", logName(gen), err)
+		}
+		w.gen = gen
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logName(w.gen)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	w.f = f
+	if err := syncDir(dir); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	w.removeBefore(w.gen)
+	s.dropExpired(time.Now())
+
+	return w, s, nil
+}
+
+func (w *WAL) loadSnapshot(gen uint64, s *state) error {
+	f, err := os.Open(filepath.Join(w.dir, snapshotName(gen)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		rec, _, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// Snapshots are only renamed into place once complete
+			return err
+		}
+		if err := s.apply(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Apply the log of generation `gen` to `s`. Only the `last` log may have a
+// damaged tail, left by a crash, which is cut off. Earlier logs were synced
+// before the next one was started, so damage there is an error rather than
+// sets to drop.
+func (w *WAL) replay(gen uint64, s *state, last bool) error {
+	f, err := os.OpenFile(filepath.Join(w.dir, logName(gen)), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = s.apply(rec)
+		}
+		if (err == io.ErrUnexpectedEOF || err == ErrCorruptRecord) && !last {
+			return fmt.Errorf("%w at offset %d", ErrCorruptRecord, offset)
+		}
+		if err == io.ErrUnexpectedEOF || err == ErrCorruptRecord {
+			log.Printf("%s: %s at offset %d, truncating\n", logName(gen), err, offset)
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			return f.Sync()
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+}
+
+// Delete snapshots and logs superseded by the snapshot of generation `gen`.
+func (w *WAL) removeBefore(gen uint64) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		old, ok := parseGeneration(name, "snapshot-", "")
+		if !ok {
+			old, ok = parseGeneration(name, "wal-", ".log")
+		}
+		if ok && old < gen {
+			os.Remove(filepath.Join(w.dir, name))
+		}
+	}
+}
+
+// Append a record to the log, syncing it right away with SyncAlways.
+func (w *WAL) Append(rec record) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return ErrWALClosed
+	}
+
+	if _, err := w.f.Write(appendRecord(nil, rec)); err != nil {
+		return err
+	}
+
+	if w.policy == SyncAlways {
+		return w.f.Sync()
+	}
+	w.dirty = true
+	return nil
+}
+
+// Flush appended records to stable storage.
+func (w *WAL) Sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.syncLocked()
+}
+
+func (w *WAL) syncLocked() error {
+	if w.closed || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.f.Sync()
+}
+
+// Start the log of the next generation and return it. Its snapshot is
+// everything appended so far.
+func (w *WAL) Rotate() (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return 0, ErrWALClosed
+	}
+
+	f, err := os.OpenFile(filepath.Join(w.dir, logName(w.gen+1)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+
+	// The previous log must be complete before a snapshot can replace it
+	w.dirty = true
+	if err := w.syncLocked(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	w.f.Close()
+
+	w.f = f
+	w.gen++
+	return w.gen, syncDir(w.dir)
+}
+
+// Save `s` as the snapshot of generation `gen` and delete the logs and
+// snapshots it supersedes.
+func (w *WAL) WriteSnapshot(gen uint64, s *state) error {
+	w.snapshotLock.Lock()
+	defer w.snapshotLock.Unlock()
+
+	tmp, err := os.CreateTemp(w.dir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	out := bufio.NewWriter(tmp)
+	var buf []byte
+	for key, value := range s.items {
+		buf = appendRecord(buf[:0], s.record(key, value))
+		out.Write(buf)
+	}
+
+	if err := out.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(w.dir, snapshotName(gen))); err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+
+	w.removeBefore(gen)
+	return nil
+}
+
+// Name of the file a cleanly closed primary leaves its replication ID and
+// sequence number in, so that replicas can carry on after a restart.
+const replicationName = "replication"
+
+// SaveReplication records that the log holds sets up to `seq` of
+// replication `id`. Only valid once the log is closed.
+func (w *WAL) SaveReplication(id string, seq uint64) error {
+	tmp, err := os.CreateTemp(w.dir, ".replication-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := fmt.Fprintf(tmp, "%s %d\n", id, seq); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(w.dir, replicationName)); err != nil {
+		return err
+	}
+	return syncDir(w.dir)
+}
+
+// TakeReplication returns what SaveReplication recorded, if anything, and
+// removes it. Sets made from now on may be lost in a crash, after which the
+// sequence number would no longer match the log.
+func (w *WAL) TakeReplication() (string, uint64, bool, error) {
+	path := filepath.Join(w.dir, replicationName)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return "", 0, false, err
+	}
+	if err := syncDir(w.dir); err != nil {
+		return "", 0, false, err
+	}
+
+	var id string
+	var seq uint64
+	if _, err := fmt.Sscanf(string(b), "%s %d\n", &id, &seq); err != nil {
+		log.Printf("Ignoring corrupt %s: %s\n", replicationName, err)
+		return "", 0, false, nil
+	}
+	return id, seq, true, nil
+}
+
+// Make a rename in `dir` durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Sync and close the log. Further appends fail with ErrWALClosed.
+func (w *WAL) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return nil
+	}
+
+	err := w.syncLocked()
+	w.closed = true
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	records := []record{
+		{op: opSet, key: "foo", value: "bar"},
+		{op: opSet, key: "", value: ""},
+		{op: opSet, key: "a=b", value: "=c=\n"},
+		{op: opSet, key: string(bytes.Repeat([]byte("k"), 300)), value: "long key"},
+		{op: opSetExpiring, key: "ttl", value: "soon", expires: 1700000000123456789},
+		{op: opSetExpiring, key: "", value: "", expires: -1},
+	}
+
+	var buf []byte
+	for _, rec := range records {
+		buf = appendRecord(buf, rec)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(buf))
+	total := 0
+	for _, want := range records {
+		have, n, err := readRecord(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("want %+v have %+v", want, have)
+		}
+		total += n
+	}
+
+	if _, _, err := readRecord(r); err != io.EOF {
+		t.Errorf("want %v have %v", io.EOF, err)
+	}
+	if total != len(buf) {
+		t.Errorf("want %d have %d", len(buf), total)
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		parsed, err := ParseSyncPolicy(policy.String())
+		if err != nil || parsed != policy {
+			t.Errorf("%s: want %v have %v %v", policy, policy, parsed, err)
+		}
+	}
+
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("want error for unknown policy")
+	}
+}
+
+// Open the DB in `dir`, failing the test on error.
+func openDB(t *testing.T, dir string) *DB {
+	t.Helper()
+
+	db, err := OpenDB(dir, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	db.Set("foo", "bar")
+	db.Set("baz", "")
+	db.Set("foo", "qux")
+	db.Close()
+
+	if err := db.Set("late", "x"); err != ErrWALClosed {
+		t.Errorf("want %v have %v", ErrWALClosed, err)
+	}
+
+	db = openDB(t, dir)
+	defer db.Close()
+
+	want := map[string]string{"foo": "qux", "baz": ""}
+	if !maps.Equal(db.items, want) {
+		t.Errorf("want %v have %v", want, db.items)
+	}
+}
+
+// Log file of the only generation in `dir`.
+func onlyLog(t *testing.T, dir string) string {
+	t.Helper()
+
+	logs, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(logs) != 1 {
+		t.Fatalf("want 1 log have %v", logs)
+	}
+	return logs[0]
+}
+
+func TestRecoveryTruncated(t *testing.T) {
+	sets := []record{
+		{op: opSet, key: "a", value: "1"},
+		{op: opSet, key: "b", value: "2"},
+		{op: opSet, key: "a", value: "3"},
+	}
+
+	// Boundaries of the records in the log
+	ends := []int{}
+	size := 0
+	for _, rec := range sets {
+		size += len(appendRecord(nil, rec))
+		ends = append(ends, size)
+	}
+
+	// Cut the log at every possible offset, as a crash mid-write would
+	for cut := 0; cut <= size; cut++ {
+		dir := t.TempDir()
+
+		db := openDB(t, dir)
+		for _, rec := range sets {
+			db.Set(rec.key, rec.value)
+		}
+		db.Close()
+
+		path := onlyLog(t, dir)
+		if err := os.Truncate(path, int64(cut)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only complete records survive
+		complete := 0
+		for complete < len(ends) && ends[complete] <= cut {
+			complete++
+		}
+		want := map[string]string{}
+		for _, rec := range sets[:complete] {
+			want[rec.key] = rec.value
+		}
+
+		db = openDB(t, dir)
+		if !maps.Equal(db.items, want) {
+			t.Errorf("cut at %d: want %v have %v", cut, want, db.items)
+		}
+
+		// The damaged tail is gone, so new sets are recovered as well
+		db.Set("after", "crash")
+		db.Close()
+
+		db = openDB(t, dir)
+		want["after"] = "crash"
+		if !maps.Equal(db.items, want) {
+			t.Errorf("cut at %d, after reopening: want %v have %v", cut, want, db.items)
+		}
+		db.Close()
+	}
+}
+
+func TestRecoveryCorrupt(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	db.Set("a", "1")
+	db.Set("b", "2")
+	db.Close()
+
+	path := onlyLog(t, dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDB(t, dir)
+	defer db.Close()
+
+	want := map[string]string{"a": "1"}
+	if !maps.Equal(db.items, want) {
+		t.Errorf("want %v have %v", want, db.items)
+	}
+}
+
+func TestRecoveryCorruptEarlierLog(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	db.Set("a", "1")
+	db.Set("b", "2")
+	if _, err := db.wal.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("c", "3")
+	db.Close()
+
+	path := filepath.Join(dir, logName(0))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sets in the middle of the history are never dropped
+	if _, err := OpenDB(dir, SyncAlways); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("want %v have %v", ErrCorruptRecord, err)
+	}
+	if have, err := os.ReadFile(path); err != nil || !bytes.Equal(have, data) {
+		t.Errorf("want log left as is have %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	for _, key := range []string{"a", "b", "c"} {
+		db.Set(key, "before")
+	}
+	if err := db.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("a", "after")
+	db.Set("d", "after")
+	if err := db.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("e", "last")
+	db.Close()
+
+	// Superseded files were compacted away
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	wantNames := []string{snapshotName(2), logName(2)}
+	if !slices.Equal(names, wantNames) {
+		t.Errorf("want %v have %v", wantNames, names)
+	}
+
+	db = openDB(t, dir)
+	defer db.Close()
+
+	want := map[string]string{"a": "after", "b": "before", "c": "before", "d": "after", "e": "last"}
+	if !maps.Equal(db.items, want) {
+		t.Errorf("want %v have %v", want, db.items)
+	}
+}
+
+func TestSnapshotInterrupted(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	db.Set("a", "1")
+	if err := db.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("b", "2")
+
+	// Crash after starting a new log, before its snapshot was written
+	if _, err := db.wal.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("c", "3")
+	os.WriteFile(filepath.Join(dir, ".snapshot-123"), []byte("partial"), 0o644)
+	db.Close()
+
+	db = openDB(t, dir)
+	defer db.Close()
+
+	want := map[string]string{"a": "1", "b": "2", "c": "3"}
+	if !maps.Equal(db.items, want) {
+		t.Errorf("want %v have %v", want, db.items)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".snapshot-123")); !os.IsNotExist(err) {
+		t.Errorf("want leftover snapshot removed have %v", err)
+	}
+}